@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 
 	"github.com/jyothri/hdd/collect"
@@ -12,6 +13,12 @@ import (
 var parentDir string
 
 func main() {
+	if err := collect.CheckRequestLimit(); err != nil {
+		log.Fatal(err)
+	}
+	if err := collect.LoadScanRetention(); err != nil {
+		log.Fatal(err)
+	}
 	if constants.StartWebServer {
 		fmt.Println("Starting web server on startup.")
 		go web.StartWebServer()
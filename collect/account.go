@@ -0,0 +1,68 @@
+package collect
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jyothri/hdd/constants"
+	"github.com/jyothri/hdd/db"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	oauth2api "google.golang.org/api/oauth2/v2"
+	"google.golang.org/api/option"
+)
+
+var accountConfig = &oauth2.Config{
+	ClientID:     constants.OauthClientId,
+	ClientSecret: constants.OauthClientSecret,
+	Endpoint:     google.Endpoint,
+	Scopes:       []string{oauth2api.UserinfoEmailScope},
+}
+
+// Returns the email address of the account of refreshToken. Unlike the token,
+// which changes each time the account is linked again, it identifies the
+// account of the stored scans. The token needs the email scope.
+func accountEmail(refreshToken string) (string, error) {
+	tokenSrc := oauth2.Token{
+		RefreshToken: refreshToken,
+	}
+	ctx := oauthContext()
+	service, err := oauth2api.NewService(ctx, option.WithTokenSource(accountConfig.TokenSource(ctx, &tokenSrc)),
+		option.WithUserAgent(constants.UserAgent))
+	if err != nil {
+		return "", fmt.Errorf("unable to create userinfo client: %w", err)
+	}
+	release := acquireRequestSlot()
+	userinfo, err := service.Userinfo.Get().Fields("email").Do()
+	release()
+	if err != nil {
+		return "", fmt.Errorf("unable to read the email of the account. Link the account again to grant the email scope: %w", err)
+	}
+	if userinfo.Email == "" {
+		return "", &ScanError{Category: ErrorCategoryAuth, Message: "token does not grant the email scope. Link the account again"}
+	}
+	return strings.ToLower(userinfo.Email), nil
+}
+
+// Rejects continuing the scan of an account with the token of another one.
+// Scans stored without an account can be continued with any token, while an
+// account which is not known does not match any stored account.
+func checkResumeAccount(scanId int, checkpoint db.ScanCheckpoint, account string) error {
+	if !checkpoint.AccountKey.Valid || checkpoint.AccountKey.String == account {
+		return nil
+	}
+	return &ScanError{Category: ErrorCategoryValidation, Message: fmt.Sprintf("scanId=%v is a scan of another account", scanId)}
+}
+
+// Returns the account to store a scan of refreshToken with. The lookup is
+// best effort, as the accounts linked before the email scope was requested
+// can still be scanned. Their scans are stored without an account, so they
+// are neither compacted nor found by a search of the account.
+func scanAccount(refreshToken string) string {
+	account, err := accountEmail(refreshToken)
+	if err != nil {
+		fmt.Printf("Storing the scan without its account. err=%v\n", err)
+		return ""
+	}
+	return account
+}
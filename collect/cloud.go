@@ -2,7 +2,8 @@ package collect
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -36,43 +37,135 @@ func getDriveService(refreshToken string) *drive.Service {
 	tokenSrc := oauth2.Token{
 		RefreshToken: refreshToken,
 	}
-	ctx := context.Background()
-	driveService, err := drive.NewService(ctx, option.WithTokenSource(cloudConfig.TokenSource(ctx, &tokenSrc)))
+	ctx := oauthContext()
+	driveService, err := drive.NewService(ctx, option.WithTokenSource(cloudConfig.TokenSource(ctx, &tokenSrc)),
+		option.WithUserAgent(constants.UserAgent))
 	checkError(err)
 	return driveService
 }
 
-func CloudDrive(driveScan GDriveScan) int {
+func CloudDrive(driveScan GDriveScan) (int, error) {
+	sinkSpec, err := parseSinkSpec(driveScan.Sink)
+	if err != nil {
+		return 0, asScanError(err, ErrorCategoryValidation)
+	}
+	// The query of a resumed scan is only known from its checkpoint, so those
+	// are keyed by the scanId.
+	key := scanKey("google_drive", accountKey(driveScan.RefreshToken), strings.TrimSpace(driveScan.QueryString))
+	if driveScan.ResumeScanId != 0 {
+		key = scanKey("google_drive", "scan", strconv.Itoa(driveScan.ResumeScanId))
+	}
+	release, err := reserveScanKey(key)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	var scanId int
+	queryString := driveScan.QueryString
+	pageToken := ""
+	filesListed := 0
+	account := scanAccount(driveScan.RefreshToken)
+	if driveScan.ResumeScanId != 0 {
+		scanId = driveScan.ResumeScanId
+		checkpoint, err := db.GetScanCheckpoint(scanId)
+		if err != nil {
+			return 0, asScanError(err, ErrorCategoryValidation)
+		}
+		if checkpoint.ScanType != "google_drive" || isScanRunning(scanId) {
+			return 0, asScanError(fmt.Errorf("scanId=%v is not a google_drive scan which can be resumed", scanId), ErrorCategoryValidation)
+		}
+		// Without a page token all the files were listed. Listing them again
+		// from the first page would duplicate them, unless the scan stopped
+		// before saving any.
+		if checkpoint.PageToken.String == "" && checkpoint.ItemsProcessed.Int64 > 0 {
+			return 0, asScanError(fmt.Errorf("scanId=%v listed all its files, there is nothing to resume", scanId), ErrorCategoryValidation)
+		}
+		// The page token is only valid for the account which listed it.
+		if err := checkResumeAccount(scanId, checkpoint, account); err != nil {
+			return 0, err
+		}
+		queryString = checkpoint.SearchFilter.String
+		pageToken = checkpoint.PageToken.String
+		filesListed = int(checkpoint.ItemsProcessed.Int64)
+	}
+	sink, err := newScanSink(sinkSpec)
+	if err != nil {
+		return 0, asScanError(err, ErrorCategoryValidation)
+	}
+	if driveScan.ResumeScanId != 0 {
+		db.ReopenScan(scanId)
+	} else {
+		scanId = db.LogStartScan("google_drive")
+		db.SaveScanMetadata("", queryString, account, scanId)
+	}
 	scanData := make(chan db.FileData, 10)
-	scanId := db.LogStartScan("google_drive")
 	driveService := getDriveService(driveScan.RefreshToken)
-	go db.SaveScanMetadata("", driveScan.QueryString, scanId)
-	go startCloudDrive(driveService, scanId, driveScan.QueryString, scanData)
-	go db.SaveStatToDb(scanId, scanData)
-	return scanId
+	ctx, progress := startScanContext(scanId, key, func() int { return len(scanData) })
+	go startCloudDrive(ctx, progress, driveService, scanId, queryString, pageToken, filesListed, scanData)
+	go saveFileData(sink, scanId, scanData)
+	return scanId, nil
 }
 
-func startCloudDrive(driveService *drive.Service, scanId int, queryString string, scanData chan<- db.FileData) {
+// Lists the files matching queryString starting at pageToken. Rate limit and
+// server errors are retried with a backoff. The token of the next page is
+// checkpointed after every page, so a scan which stopped e.g. as the daily
+// quota ran out can be resumed later.
+func startCloudDrive(ctx context.Context, progress *scanProgress, driveService *drive.Service, scanId int, queryString string,
+	pageToken string, filesListed int, scanData chan<- db.FileData) {
 	lock.Lock()
 	defer lock.Unlock()
-	filesListCall := driveService.Files.List().PageSize(pageSize).Q(queryString).Fields(googleapi.Field(strings.Join(append(addPrefix(fields, "files/"), paginationFields...), ",")))
+	ticker := newProgressTicker()
+	done := make(chan bool)
+	go logProgress(progress, done, ticker)
+	filesListCall := driveService.Files.List().PageSize(pageSize).Q(queryString).PageToken(pageToken).Fields(googleapi.Field(strings.Join(append(addPrefix(fields, "files/"), paginationFields...), ",")))
+	retries := constants.DriveListRetries
 	hasNextPage := true
-	for hasNextPage {
+	for hasNextPage && ctx.Err() == nil {
+		release := acquireRequestSlot()
 		fileList, err := filesListCall.Do()
-		checkError(err)
+		release()
+		if err != nil {
+			category := categorize(err, "")
+			if retries > 0 && (category == ErrorCategoryQuota || category == ErrorCategoryNetwork) {
+				attempt := constants.DriveListRetries - retries
+				retries--
+				fmt.Printf("Retrying listing files of scanId=%v. attempt=%v err=%v\n", scanId, attempt+1, err)
+				sleepContext(ctx, retryBackoff(attempt))
+				continue
+			}
+			failDriveScan(scanId, pageToken, filesListed, err)
+			break
+		}
+		retries = constants.DriveListRetries
 		if fileList.IncompleteSearch {
-			checkError(errors.New("incomplete search from drive API"))
+			// Some of the matching files may be missing from the listing.
+			fmt.Printf("Incomplete search from drive API for scanId=%v\n", scanId)
+			db.LogScanWarning(scanId, "drive API reported an incomplete search, some files may be missing")
 		}
-		parseFileList(fileList, scanData)
+		parseFileList(progress, fileList, scanData)
+		filesListed += len(fileList.Files)
+		pageToken = fileList.NextPageToken
+		db.SaveScanCheckpoint(scanId, pageToken, filesListed)
 		if fileList.NextPageToken == "" {
 			hasNextPage = false
 		}
 		filesListCall = filesListCall.PageToken(fileList.NextPageToken)
 	}
+	done <- true
+	ticker.Stop()
 	close(scanData)
 }
 
-func parseFileList(fileList *drive.FileList, scanData chan<- db.FileData) {
+// Fails the scan with the category of err. The results listed so far are kept
+// and the scan can be resumed from pageToken with ResumeScanId.
+func failDriveScan(scanId int, pageToken string, filesListed int, err error) {
+	category := categorize(err, ErrorCategoryNetwork)
+	fmt.Printf("Failing scanId=%v after %v files. category=%v err=%v\n", scanId, filesListed, category, err)
+	db.SaveScanCheckpoint(scanId, pageToken, filesListed)
+	db.MarkScanFailed(scanId, string(category), fmt.Sprintf("stopped listing files: %v", err))
+}
+
+func parseFileList(progress *scanProgress, fileList *drive.FileList, scanData chan<- db.FileData) {
 	for _, file := range fileList.Files {
 		fd := db.FileData{
 			FileName:  file.Name,
@@ -85,7 +178,10 @@ func parseFileList(fileList *drive.FileList, scanData chan<- db.FileData) {
 			fd.Size = uint(file.Size)
 			fd.FileCount = 1
 			fd.Md5Hash = file.Md5Checksum
+			sendStart := time.Now()
 			scanData <- fd
+			progress.sent(sendStart)
+			progress.addProcessed()
 		}
 	}
 }
@@ -107,4 +203,10 @@ func parseTime(inputTime string) time.Time {
 type GDriveScan struct {
 	QueryString  string
 	RefreshToken string
+	// Destination for the results. See newScanSink for the supported values.
+	Sink string
+	// Continues an earlier google_drive scan which stopped before listing all
+	// the files, e.g. as the quota ran out. The query of the earlier scan is
+	// used and the token has to be of the same account.
+	ResumeScanId int
 }
@@ -2,45 +2,81 @@ package collect
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/jyothri/hdd/constants"
 	"github.com/jyothri/hdd/db"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
-func CloudStorage(gStorageScan GStorageScan) int {
+func CloudStorage(gStorageScan GStorageScan) (int, error) {
+	sinkSpec, err := parseSinkSpec(gStorageScan.Sink)
+	if err != nil {
+		return 0, asScanError(err, ErrorCategoryValidation)
+	}
+	if gStorageScan.maxHashSize() < 0 {
+		return 0, &ScanError{Category: ErrorCategoryValidation, Message: fmt.Sprintf("invalid MaxHashSize %v", gStorageScan.maxHashSize())}
+	}
+	key := scanKey("google_storage", gStorageScan.Bucket)
+	release, err := reserveScanKey(key)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	sink, err := newScanSink(sinkSpec)
+	if err != nil {
+		return 0, asScanError(err, ErrorCategoryValidation)
+	}
 	scanData := make(chan db.FileData, 10)
 	scanId := db.LogStartScan("google_storage")
-	go db.SaveScanMetadata("bucket="+gStorageScan.Bucket, "", scanId)
-	go startCloudStorage(scanId, gStorageScan.Bucket, scanData)
-	go db.SaveStatToDb(scanId, scanData)
-	return scanId
+	db.SaveScanMetadata("bucket="+gStorageScan.Bucket, "", "", scanId)
+	ctx, progress := startScanContext(scanId, key, func() int { return len(scanData) })
+	go startCloudStorage(ctx, progress, scanId, gStorageScan, scanData)
+	go saveFileData(sink, scanId, scanData)
+	return scanId, nil
 }
 
-func startCloudStorage(scanId int, bucketName string, scanData chan<- db.FileData) {
+func startCloudStorage(ctx context.Context, progress *scanProgress, scanId int, gStorageScan GStorageScan, scanData chan<- db.FileData) {
 	lock.Lock()
 	defer lock.Unlock()
-	ctx := context.Background()
+	ticker := newProgressTicker()
+	done := make(chan bool)
+	go logProgress(progress, done, ticker)
 
 	// Create a client.
-	client, err := storage.NewClient(ctx)
-	checkError(err)
+	client, err := storage.NewClient(ctx, option.WithUserAgent(constants.UserAgent))
+	if err != nil {
+		failScan(scanId, fmt.Errorf("unable to create cloud storage client: %w", err), ErrorCategoryAuth)
+		closeStorageScan(done, ticker, scanData)
+		return
+	}
 	defer client.Close()
 
 	// Create a Bucket instance.
-	bucket := client.Bucket(bucketName)
+	bucket := client.Bucket(gStorageScan.Bucket)
 
 	query := &storage.Query{Prefix: ""}
 
 	it := bucket.Objects(ctx, query)
-	for {
+	for ctx.Err() == nil {
+		// Next fetches a new page of objects once the current one is consumed.
+		release := acquireRequestSlot()
 		attrs, err := it.Next()
-		if err == iterator.Done {
+		release()
+		if err == iterator.Done || ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			failScan(scanId, fmt.Errorf("stopped listing objects: %w", err), ErrorCategoryNetwork)
 			break
 		}
-		checkError(err)
 		fd := db.FileData{
 			FilePath:  attrs.MediaLink,
 			IsDir:     false,
@@ -49,13 +85,59 @@ func startCloudStorage(scanId int, bucketName string, scanData chan<- db.FileDat
 			Size:      uint(attrs.Size),
 			Md5Hash:   fmt.Sprintf("%x", attrs.MD5),
 		}
+		if attrs.MD5 == nil {
+			// Composite objects only have a CRC32C checksum.
+			fd.Md5Hash = getObjectHash(ctx, bucket, gStorageScan, attrs)
+		}
 		fileName := getFileName(attrs.Name)
 		fd.FileName = fileName
+		sendStart := time.Now()
 		scanData <- fd
+		progress.sent(sendStart)
+		progress.addProcessed()
 	}
+	closeStorageScan(done, ticker, scanData)
+}
+
+func closeStorageScan(done chan<- bool, ticker *time.Ticker, scanData chan<- db.FileData) {
+	done <- true
+	ticker.Stop()
 	close(scanData)
 }
 
+// Downloads the object and hashes its content, when requested and the object
+// is not larger than maxHashSize. Otherwise or when the download fails the
+// CRC32C checksum of the object is returned instead.
+func getObjectHash(ctx context.Context, bucket *storage.BucketHandle, gStorageScan GStorageScan, attrs *storage.ObjectAttrs) string {
+	crc32c := fmt.Sprintf("crc32c:%08x", attrs.CRC32C)
+	maxHashSize := gStorageScan.maxHashSize()
+	if !gStorageScan.FetchMd5Hash || (maxHashSize > 0 && attrs.Size > maxHashSize) {
+		return crc32c
+	}
+	release := acquireRequestSlot()
+	defer release()
+	reader, err := bucket.Object(attrs.Name).NewReader(ctx)
+	if err != nil {
+		fmt.Printf("Unable to download object %v. err=%v\n", attrs.Name, err)
+		return crc32c
+	}
+	defer reader.Close()
+	hash := md5.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		fmt.Printf("Unable to download object %v. err=%v\n", attrs.Name, err)
+		return crc32c
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (gStorageScan GStorageScan) maxHashSize() int64 {
+	if gStorageScan.MaxHashSize == nil {
+		return constants.StorageMaxHashSize
+	}
+	return *gStorageScan.MaxHashSize
+}
+
 func getFileName(objectPath string) string {
 	fileParts := strings.Split(objectPath, "/")
 	if len(fileParts) < 1 {
@@ -66,4 +148,13 @@ func getFileName(objectPath string) string {
 
 type GStorageScan struct {
 	Bucket string
+	// Objects without a MD5 hash, e.g. composite objects, are downloaded and
+	// hashed. Objects larger than MaxHashSize bytes are not downloaded, it
+	// defaults to the storage_max_hash_size flag and 0 downloads every object.
+	// The CRC32C checksum of the objects which are not downloaded is recorded
+	// as crc32c:<checksum> instead.
+	FetchMd5Hash bool
+	MaxHashSize  *int64
+	// Destination for the results. See newScanSink for the supported values.
+	Sink string
 }
@@ -1,12 +1,87 @@
 package collect
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"sync"
+	"time"
+
+	"github.com/jyothri/hdd/constants"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/semaphore"
 )
 
 var lock sync.RWMutex
 
+// Process wide limit on the network calls in flight. Shared by all the
+// collectors on top of the per API rate limiters.
+var requestSemaphore = semaphore.NewWeighted(constants.MaxConcurrentRequests)
+
+// Checks the max_concurrent_requests flag. Invoked on startup, as without a
+// slot every request would block forever.
+func CheckRequestLimit() error {
+	if constants.MaxConcurrentRequests < 1 {
+		return fmt.Errorf("invalid max_concurrent_requests %v. at least 1 request has to be allowed", constants.MaxConcurrentRequests)
+	}
+	return nil
+}
+
+// Blocks until a request slot is available. The returned func releases the slot.
+func acquireRequestSlot() func() {
+	err := requestSemaphore.Acquire(context.Background(), 1)
+	checkError(err)
+	return func() {
+		requestSemaphore.Release(1)
+	}
+}
+
+// Exponential backoff to wait before the retry following attempt (0 based).
+func retryBackoff(attempt int) time.Duration {
+	const maxBackoff = 30 * time.Second
+	if attempt > 5 {
+		return maxBackoff
+	}
+	backoff := time.Second << uint(attempt)
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// Waits for d unless ctx is done first. Reports whether the full wait passed,
+// so that a cancelled scan stops instead of retrying.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Sets the User-Agent of the requests to the user_agent flag.
+type userAgentTransport struct {
+	base http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", constants.UserAgent)
+	return t.base.RoundTrip(req)
+}
+
+// Client for the requests made without a token, e.g. downloads of photos.
+var userAgentClient = &http.Client{Transport: userAgentTransport{http.DefaultTransport}}
+
+// Context for the oauth2 token sources and clients, so that the token
+// requests also carry the User-Agent.
+func oauthContext() context.Context {
+	return context.WithValue(context.Background(), oauth2.HTTPClient, userAgentClient)
+}
+
 func checkError(err error, msg ...string) {
 	if err != nil {
 		fmt.Println(msg)
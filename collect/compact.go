@@ -0,0 +1,62 @@
+package collect
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jyothri/hdd/constants"
+	"github.com/jyothri/hdd/db"
+)
+
+// Number of scans of a source to keep the rows of, keyed by scan type.
+// Scan types which are not listed keep all their scans. Set by
+// LoadScanRetention.
+var scanRetention = map[string]int{}
+
+// Reads the retain_scans flag. Invoked on startup, so that an invalid flag
+// stops the server before any scan completes.
+func LoadScanRetention() error {
+	retention, err := parseScanRetention(constants.RetainScans)
+	if err != nil {
+		return err
+	}
+	scanRetention = retention
+	return nil
+}
+
+func parseScanRetention(spec string) (map[string]int, error) {
+	retention := make(map[string]int)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid retain_scans entry %q. expected <scan type>=<count>", entry)
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("invalid retain_scans entry %q. at least 1 scan has to be kept", entry)
+		}
+		retention[strings.TrimSpace(parts[0])] = count
+	}
+	return retention, nil
+}
+
+// Deletes the rows of the older scans of the same source as scanId when the
+// retain_scans flag limits its scan type. Invoked once the scan completed, so
+// that the scan itself is one of the scans kept.
+func compactScans(scanId int) {
+	scanType, err := db.GetScanTypeFromDb(scanId)
+	checkError(err)
+	keep, present := scanRetention[scanType]
+	if !present {
+		return
+	}
+	scanIds := db.CompactScans(scanId, keep)
+	if len(scanIds) > 0 {
+		fmt.Printf("Compacted scans %v of the source of scanId=%v\n", scanIds, scanId)
+	}
+}
@@ -0,0 +1,114 @@
+package collect
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/jyothri/hdd/db"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Category of a scan failure. Tells the user what to do about it, e.g. to
+// link the account again for AUTH.
+type ErrorCategory string
+
+const (
+	ErrorCategoryAuth       ErrorCategory = "AUTH"
+	ErrorCategoryQuota      ErrorCategory = "QUOTA"
+	ErrorCategoryNetwork    ErrorCategory = "NETWORK"
+	ErrorCategoryDB         ErrorCategory = "DB"
+	ErrorCategoryValidation ErrorCategory = "VALIDATION"
+	// None of the above could be told from the error.
+	ErrorCategoryUnknown ErrorCategory = "UNKNOWN"
+)
+
+// ScanError is returned when a scan could not be started or failed.
+type ScanError struct {
+	Category ErrorCategory
+	Message  string
+	err      error
+}
+
+func (e *ScanError) Error() string {
+	return e.Message
+}
+
+func (e *ScanError) Unwrap() error {
+	return e.err
+}
+
+// DuplicateScanError is returned when a scan of the same source is already
+// running. ScanId is 0 while that scan is still being started.
+type DuplicateScanError struct {
+	ScanId int
+}
+
+func (e *DuplicateScanError) Error() string {
+	if e.ScanId == 0 {
+		return "a scan of the same source is being started"
+	}
+	return fmt.Sprintf("a scan of the same source is already running with scanId=%v", e.ScanId)
+}
+
+// Wraps err in a ScanError. The category is derived from the errors in the
+// chain of err, defaulting to fallback when none of them is recognized.
+func asScanError(err error, fallback ErrorCategory) error {
+	if err == nil {
+		return nil
+	}
+	var scanErr *ScanError
+	var duplicateErr *DuplicateScanError
+	if errors.As(err, &scanErr) || errors.As(err, &duplicateErr) {
+		return err
+	}
+	return &ScanError{Category: categorize(err, fallback), Message: err.Error(), err: err}
+}
+
+func categorize(err error, fallback ErrorCategory) ErrorCategory {
+	var scanErr *ScanError
+	if errors.As(err, &scanErr) {
+		return scanErr.Category
+	}
+	// Token errors are wrapped in url.Error, which is also a net.Error.
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return ErrorCategoryAuth
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return categorizeStatus(apiErr.Code, apiErr.Errors, fallback)
+	}
+	if db.IsDatabaseError(err) {
+		return ErrorCategoryDB
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrorCategoryNetwork
+	}
+	return fallback
+}
+
+// Maps the status code of a failed Google API call to a category. Rate limits
+// are reported with 403 by some of the APIs, those are told apart by reason.
+func categorizeStatus(statusCode int, errorItems []googleapi.ErrorItem, fallback ErrorCategory) ErrorCategory {
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorCategoryQuota
+	case statusCode == http.StatusForbidden:
+		for _, item := range errorItems {
+			switch item.Reason {
+			case "rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded", "dailyLimitExceeded":
+				return ErrorCategoryQuota
+			}
+		}
+		return ErrorCategoryAuth
+	case statusCode == http.StatusUnauthorized:
+		return ErrorCategoryAuth
+	case statusCode >= http.StatusInternalServerError:
+		return ErrorCategoryNetwork
+	}
+	return fallback
+}
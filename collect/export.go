@@ -0,0 +1,225 @@
+package collect
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jyothri/hdd/constants"
+	"github.com/jyothri/hdd/db"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Number of rows read from the database and appended to the sheet at a time.
+const exportBatchSize = 1000
+
+var sheetsConfig *oauth2.Config
+
+// State of the latest export of a scan to a spreadsheet.
+type ExportStatus struct {
+	SpreadsheetUrl string `json:"spreadsheet_url"`
+	// One of running, complete or failed.
+	State        string `json:"state"`
+	RowsExported int    `json:"rows_exported"`
+	// Set when the export failed.
+	ErrorCategory ErrorCategory `json:"error_category,omitempty"`
+	Error         string        `json:"error,omitempty"`
+	spreadsheetId string
+}
+
+// The latest export of each scan keyed by the scanId. Only kept in memory,
+// the status of an export is lost on a restart of the server.
+var exports = struct {
+	sync.Mutex
+	status map[int]ExportStatus
+}{status: make(map[int]ExportStatus)}
+
+func init() {
+	sheetsConfig = &oauth2.Config{
+		ClientID:     constants.OauthClientId,
+		ClientSecret: constants.OauthClientSecret,
+		Endpoint:     google.Endpoint,
+		Scopes:       []string{sheets.SpreadsheetsScope},
+	}
+}
+
+func getSheetsService(refreshToken string) *sheets.Service {
+	tokenSrc := oauth2.Token{
+		RefreshToken: refreshToken,
+	}
+	ctx := oauthContext()
+	sheetsService, err := sheets.NewService(ctx, option.WithTokenSource(sheetsConfig.TokenSource(ctx, &tokenSrc)),
+		option.WithUserAgent(constants.UserAgent))
+	checkError(err)
+	return sheetsService
+}
+
+// Exports the results of the scan to a new spreadsheet owned by the token and
+// returns the url of the spreadsheet. The spreadsheet is created right away,
+// the rows are appended in the background in batches of exportBatchSize.
+func ExportScanToSheets(scanId int, refreshToken string) (string, error) {
+	scanType, err := db.GetScanTypeFromDb(scanId)
+	if err != nil {
+		return "", asScanError(err, ErrorCategoryValidation)
+	}
+	readBatch, header, err := exportReader(scanId, scanType)
+	if err != nil {
+		return "", asScanError(err, ErrorCategoryValidation)
+	}
+	sheetsService := getSheetsService(refreshToken)
+	spreadsheet := &sheets.Spreadsheet{
+		Properties: &sheets.SpreadsheetProperties{
+			Title: fmt.Sprintf("bhandaar %v scan %v", scanType, scanId),
+		},
+	}
+	release := acquireRequestSlot()
+	spreadsheet, err = sheetsService.Spreadsheets.Create(spreadsheet).Do()
+	release()
+	if err != nil {
+		return "", asScanError(fmt.Errorf("unable to create spreadsheet: %w", err), ErrorCategoryUnknown)
+	}
+	setExportStatus(scanId, ExportStatus{SpreadsheetUrl: spreadsheet.SpreadsheetUrl, State: "running",
+		spreadsheetId: spreadsheet.SpreadsheetId})
+	go exportRows(sheetsService, spreadsheet.SpreadsheetId, scanId, header, readBatch)
+	return spreadsheet.SpreadsheetUrl, nil
+}
+
+// Reads the rows of a scan with id greater than afterId. Returns the rows as
+// sheet values along with the id of the last row read.
+type exportBatchReader func(afterId int) ([][]interface{}, int)
+
+func exportReader(scanId int, scanType string) (exportBatchReader, []interface{}, error) {
+	switch scanType {
+	case "local", "google_drive", "google_storage":
+		header := []interface{}{"Name", "Path", "Size", "Modified Time", "Md5 Hash", "Is Dir", "File Count"}
+		return func(afterId int) ([][]interface{}, int) {
+			rows := [][]interface{}{}
+			for _, sd := range db.GetScanDataBatchFromDb(scanId, afterId, exportBatchSize) {
+				rows = append(rows, []interface{}{sd.Name.String, sd.Path.String, sheetValue(sd.Size),
+					sheetValue(sd.ModifiedTime), sd.Md5Hash.String, sd.IsDir.Bool, sd.FileCount.Int32})
+				afterId = sd.Id
+			}
+			return rows, afterId
+		}, header, nil
+	case "gmail":
+		header := []interface{}{"Message Id", "Thread Id", "Date", "From", "To", "Subject", "Size Estimate", "Labels"}
+		return func(afterId int) ([][]interface{}, int) {
+			rows := [][]interface{}{}
+			for _, md := range db.GetMessageMetadataBatchFromDb(scanId, afterId, exportBatchSize) {
+				labels := md.LabelIds.String
+				if md.LabelNames.Valid {
+					labels = md.LabelNames.String
+				}
+				rows = append(rows, []interface{}{md.MessageId.String, md.ThreadId.String, md.Date.Format(),
+					md.From.String, md.To.String, md.Subject.String, sheetValue(md.SizeEstimate), labels})
+				afterId = md.Id
+			}
+			return rows, afterId
+		}, header, nil
+	case "photos":
+		header := []interface{}{"Media Item Id", "Filename", "Mime Type", "Size", "Modified Time", "Md5 Hash",
+			"Contributor", "Contributor Profile Url", "Product Url", "Latitude", "Longitude"}
+		return func(afterId int) ([][]interface{}, int) {
+			rows := [][]interface{}{}
+			for _, pmi := range db.GetPhotosMediaItemBatchFromDb(scanId, afterId, exportBatchSize) {
+				rows = append(rows, []interface{}{pmi.MediaItemId, pmi.Filename, pmi.MimeType.String,
+					sheetValue(pmi.Size), sheetValue(pmi.ModifiedTime), pmi.Md5hash.String,
+					pmi.ContributorDisplayName.String, pmi.ContributorProfileUrl.String, pmi.ProductUrl, sheetValue(pmi.Latitude),
+					sheetValue(pmi.Longitude)})
+				afterId = pmi.Id
+			}
+			return rows, afterId
+		}, header, nil
+	default:
+		return nil, nil, fmt.Errorf("export is not supported for scan type %q", scanType)
+	}
+}
+
+func exportRows(sheetsService *sheets.Service, spreadsheetId string, scanId int, header []interface{}, readBatch exportBatchReader) {
+	rows := [][]interface{}{header}
+	lastId := 0
+	exported := 0
+	for {
+		batch, afterId := readBatch(lastId)
+		rows = append(rows, batch...)
+		if len(rows) > 0 {
+			err := appendRows(sheetsService, spreadsheetId, rows)
+			if err != nil {
+				fmt.Printf("Export of scanId=%v to spreadsheet %v stopped after %v rows. err=%v\n", scanId, spreadsheetId, exported, err)
+				updateExportStatus(scanId, spreadsheetId, func(status *ExportStatus) {
+					status.State = "failed"
+					status.ErrorCategory = categorize(err, ErrorCategoryUnknown)
+					status.Error = err.Error()
+				})
+				return
+			}
+		}
+		exported += len(batch)
+		updateExportStatus(scanId, spreadsheetId, func(status *ExportStatus) {
+			status.RowsExported = exported
+		})
+		if len(batch) < exportBatchSize {
+			break
+		}
+		rows = nil
+		lastId = afterId
+	}
+	fmt.Printf("Exported %v rows of scanId=%v to spreadsheet %v\n", exported, scanId, spreadsheetId)
+	updateExportStatus(scanId, spreadsheetId, func(status *ExportStatus) {
+		status.State = "complete"
+	})
+}
+
+// Returns the status of the latest export of the scan since the server
+// started. Returns false when the scan was not exported.
+func GetExportStatus(scanId int) (ExportStatus, bool) {
+	exports.Lock()
+	defer exports.Unlock()
+	status, ok := exports.status[scanId]
+	return status, ok
+}
+
+func setExportStatus(scanId int, status ExportStatus) {
+	exports.Lock()
+	defer exports.Unlock()
+	exports.status[scanId] = status
+}
+
+// Updates the status of the export to spreadsheetId. Does nothing once the
+// scan was exported again, to another spreadsheet.
+func updateExportStatus(scanId int, spreadsheetId string, update func(status *ExportStatus)) {
+	exports.Lock()
+	defer exports.Unlock()
+	status, ok := exports.status[scanId]
+	if !ok || status.spreadsheetId != spreadsheetId {
+		return
+	}
+	update(&status)
+	exports.status[scanId] = status
+}
+
+func appendRows(sheetsService *sheets.Service, spreadsheetId string, rows [][]interface{}) error {
+	valueRange := &sheets.ValueRange{Values: rows}
+	release := acquireRequestSlot()
+	defer release()
+	_, err := sheetsService.Spreadsheets.Values.Append(spreadsheetId, "A1", valueRange).
+		ValueInputOption("RAW").InsertDataOption("INSERT_ROWS").Do()
+	return err
+}
+
+// Converts a nullable column to a sheet value. Null is exported as an empty cell.
+func sheetValue(value driver.Valuer) interface{} {
+	v, _ := value.Value()
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return v
+	}
+}
@@ -2,7 +2,11 @@ package collect
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,11 +16,13 @@ import (
 	"golang.org/x/oauth2/google"
 	"golang.org/x/time/rate"
 	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
-var counter_processed int
-var counter_pending int
+// Special Gmail userId which refers to the owner of the token.
+const defaultGmailUserId = "me"
+
 var gmailConfig *oauth2.Config
 
 func init() {
@@ -32,42 +38,195 @@ func getGmailService(refreshToken string) *gmail.Service {
 	tokenSrc := oauth2.Token{
 		RefreshToken: refreshToken,
 	}
-	ctx := context.Background()
-	gmailService, err := gmail.NewService(ctx, option.WithTokenSource(gmailConfig.TokenSource(ctx, &tokenSrc)))
+	ctx := oauthContext()
+	gmailService, err := gmail.NewService(ctx, option.WithTokenSource(gmailConfig.TokenSource(ctx, &tokenSrc)),
+		option.WithUserAgent(constants.UserAgent))
 	checkError(err)
 	return gmailService
 }
 
-func Gmail(gMailScan GMailScan) int {
-	messageMetaData := make(chan db.MessageMetadata, 10)
-	scanId := db.LogStartScan("gmail")
-	go db.SaveScanMetadata("", gMailScan.Filter, scanId)
+// Requests per second to the Gmail API of each scan.
+const (
+	gmailRateLimit = 50
+	gmailBurst     = 5
+)
+
+func Gmail(gMailScan GMailScan) (int, error) {
+	userId := gMailScan.UserId
+	if userId == "" {
+		userId = defaultGmailUserId
+	}
+	sinkSpec, err := parseSinkSpec(gMailScan.Sink)
+	if err != nil {
+		return 0, asScanError(err, ErrorCategoryValidation)
+	}
+	// Taken before calling the API or the database, so that a duplicate is
+	// rejected before it has any effect. The filter of a resumed scan is only
+	// known from its checkpoint, so those are keyed by the scanId instead.
+	key := scanKey("gmail", accountKey(gMailScan.RefreshToken), userId, strings.TrimSpace(gMailScan.Filter))
+	if gMailScan.ResumeScanId != 0 {
+		key = scanKey("gmail", "scan", strconv.Itoa(gMailScan.ResumeScanId))
+	}
+	release, err := reserveScanKey(key)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	var scanId int
+	filter := gMailScan.Filter
+	pageToken := ""
+	messagesListed := 0
+	account := scanAccount(gMailScan.RefreshToken)
+	if gMailScan.ResumeScanId != 0 {
+		scanId = gMailScan.ResumeScanId
+		checkpoint, err := db.GetScanCheckpoint(scanId)
+		if err != nil {
+			return 0, asScanError(err, ErrorCategoryValidation)
+		}
+		if checkpoint.ScanType != "gmail" || isScanRunning(scanId) {
+			return 0, asScanError(fmt.Errorf("scanId=%v is not a gmail scan which can be resumed", scanId), ErrorCategoryValidation)
+		}
+		// The page token and the messages saved so far are of the mailbox
+		// of the earlier scan.
+		if !strings.HasPrefix(checkpoint.SearchPath.String, "mailbox=") {
+			return 0, &ScanError{Category: ErrorCategoryValidation, Message: fmt.Sprintf("mailbox of scanId=%v is unknown, start a new scan instead", scanId)}
+		}
+		mailbox := strings.TrimPrefix(checkpoint.SearchPath.String, "mailbox=")
+		if gMailScan.UserId != "" && gMailScan.UserId != mailbox {
+			return 0, &ScanError{Category: ErrorCategoryValidation, Message: fmt.Sprintf("scanId=%v is a scan of mailbox %q, not %q", scanId, mailbox, gMailScan.UserId)}
+		}
+		userId = mailbox
+		if err := checkResumeAccount(scanId, checkpoint, account); err != nil {
+			return 0, err
+		}
+		filter = checkpoint.SearchFilter.String
+		pageToken = checkpoint.PageToken.String
+		messagesListed = int(checkpoint.ItemsProcessed.Int64)
+	}
 	gmailService := getGmailService(gMailScan.RefreshToken)
-	go startGmailScan(gmailService, scanId, gMailScan.Filter, messageMetaData)
-	go db.SaveMessageMetadataToDb(scanId, messageMetaData)
-	return scanId
+	err = checkMailboxAccess(gmailService, userId)
+	if err != nil {
+		return 0, asScanError(err, ErrorCategoryValidation)
+	}
+	var labelNames map[string]string
+	if gMailScan.FetchLabelNames {
+		labelNames, err = getLabelNames(gmailService, userId)
+		if err != nil {
+			return 0, asScanError(err, ErrorCategoryValidation)
+		}
+	}
+	sink, err := newScanSink(sinkSpec)
+	if err != nil {
+		return 0, asScanError(err, ErrorCategoryValidation)
+	}
+	if gMailScan.ResumeScanId != 0 {
+		db.ReopenScan(scanId)
+	} else {
+		scanId = db.LogStartScan("gmail")
+		db.SaveScanMetadata("mailbox="+userId, filter, account, scanId)
+	}
+	messageMetaData := make(chan db.MessageMetadata, 10)
+	ctx, progress := startScanContext(scanId, key, func() int { return len(messageMetaData) })
+	go startGmailScan(ctx, progress, gmailService, scanId, userId, labelNames, filter, pageToken, messagesListed, messageMetaData)
+	go saveMessageMetadata(sink, scanId, messageMetaData)
+	return scanId, nil
+}
+
+// Returns the estimated number of messages matching filter without fetching
+// any of them, so that the size of a scan is known before starting it.
+func PreviewGmailFilter(refreshToken string, filter string) (int64, error) {
+	gmailService := getGmailService(refreshToken)
+	release := acquireRequestSlot()
+	messageList, err := gmailService.Users.Messages.List(defaultGmailUserId).Q(filter).
+		MaxResults(1).Fields("resultSizeEstimate").Do()
+	release()
+	if err != nil {
+		return 0, asScanError(fmt.Errorf("unable to list messages: %w", err), ErrorCategoryValidation)
+	}
+	return messageList.ResultSizeEstimate, nil
+}
+
+// Verifies the token can read the mailbox of userId before a scan is started.
+// Any userId other than "me" needs a token with domain-wide delegation for
+// that user, otherwise the Gmail API rejects the request.
+func checkMailboxAccess(gmailService *gmail.Service, userId string) error {
+	release := acquireRequestSlot()
+	_, err := gmailService.Users.GetProfile(userId).Do()
+	release()
+	if err == nil {
+		return nil
+	}
+	if userId == defaultGmailUserId {
+		return fmt.Errorf("unable to access mailbox: %w", err)
+	}
+	return fmt.Errorf("unable to access mailbox of user %q. "+
+		"Token needs domain-wide delegation for this user: %w", userId, err)
 }
 
-func startGmailScan(gmailService *gmail.Service, scanId int, queryString string, messageMetaData chan<- db.MessageMetadata) {
+// Retrieves the label id to label name mapping for the mailbox. It is fetched
+// once per scan and shared by all the messages of the scan.
+func getLabelNames(gmailService *gmail.Service, userId string) (map[string]string, error) {
+	release := acquireRequestSlot()
+	labelList, err := gmailService.Users.Labels.List(userId).Do()
+	release()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list labels: %w", err)
+	}
+	labelNames := make(map[string]string, len(labelList.Labels))
+	for _, label := range labelList.Labels {
+		labelNames[label.Id] = label.Name
+	}
+	return labelNames, nil
+}
+
+// Lists the messages matching queryString starting at pageToken. The token of
+// the page before the one being fetched is checkpointed, so an interrupted scan
+// is resumed from there. Messages which are fetched again are not duplicated.
+func startGmailScan(ctx context.Context, progress *scanProgress, gmailService *gmail.Service, scanId int, userId string, labelNames map[string]string,
+	queryString string, pageToken string, messagesListed int, messageMetaData chan<- db.MessageMetadata) {
 	lock.Lock()
 	defer lock.Unlock()
 	var wg sync.WaitGroup
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := newProgressTicker()
 	done := make(chan bool)
-	go logProgressToConsole(done, ticker)
-	throttler := rate.NewLimiter(50, 5)
+	go logProgress(progress, done, ticker)
+	throttler := rate.NewLimiter(gmailRateLimit, gmailBurst)
 
-	messageListCall := gmailService.Users.Messages.List("me").Q(queryString)
+	messageListCall := gmailService.Users.Messages.List(userId).Q(queryString).PageToken(pageToken)
+	previousPageToken := pageToken
+	previousPageOffset := messagesListed
+	resumed := pageToken != ""
 	hasNextPage := true
-	for hasNextPage {
+	for hasNextPage && ctx.Err() == nil {
+		release := acquireRequestSlot()
 		messageList, err := messageListCall.Do()
-		checkError(err)
+		release()
+		if err != nil && resumed && isInvalidPageToken(err) {
+			// Page tokens expire after a while. Fall back to scanning from the start.
+			fmt.Printf("Stored page token for scanId=%v expired. Restarting the scan from first page.\n", scanId)
+			pageToken = ""
+			messagesListed = 0
+			previousPageToken, previousPageOffset = "", 0
+			messageListCall = messageListCall.PageToken(pageToken)
+			resumed = false
+			continue
+		}
+		if err != nil {
+			// The checkpoint of the previous page is kept, so the scan can be
+			// resumed from there.
+			failScan(scanId, fmt.Errorf("stopped listing messages after %v: %w", messagesListed, err), ErrorCategoryNetwork)
+			break
+		}
+		resumed = false
+		db.SaveScanCheckpoint(scanId, previousPageToken, previousPageOffset)
+		previousPageToken, previousPageOffset = pageToken, messagesListed
+		pageToken = messageList.NextPageToken
+		messagesListed += len(messageList.Messages)
 		err = throttler.Wait(context.Background())
 		checkError(err, fmt.Sprintf("Error with limiter: %s", err))
 
-		wg.Add(len(messageList.Messages))
-		counter_pending += len(messageList.Messages)
-		parseMessageList(gmailService, messageList, messageMetaData, &wg, throttler)
+		progress.addPending(len(messageList.Messages))
+		parseMessageList(ctx, progress, gmailService, userId, labelNames, messageList, messageMetaData, &wg, throttler)
 		if messageList.NextPageToken == "" {
 			hasNextPage = false
 		}
@@ -79,17 +238,51 @@ func startGmailScan(gmailService *gmail.Service, scanId int, queryString string,
 	close(messageMetaData)
 }
 
-func parseMessageList(gmailService *gmail.Service, messageList *gmail.ListMessagesResponse, messageMetaData chan<- db.MessageMetadata, wg *sync.WaitGroup, throttler *rate.Limiter) {
+// Reports whether the list call failed because of the page token, e.g.
+// 400 "Invalid pageToken" once the token has expired. Other bad requests
+// fail the scan instead of restarting it.
+func isInvalidPageToken(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+		return false
+	}
+	if mentionsPageToken(apiErr.Message) {
+		return true
+	}
+	for _, item := range apiErr.Errors {
+		if mentionsPageToken(item.Message) || mentionsPageToken(item.Reason) {
+			return true
+		}
+	}
+	return false
+}
+
+func mentionsPageToken(s string) bool {
+	return strings.Contains(strings.ToLower(s), "pagetoken")
+}
+
+func parseMessageList(ctx context.Context, progress *scanProgress, gmailService *gmail.Service, userId string, labelNames map[string]string, messageList *gmail.ListMessagesResponse, messageMetaData chan<- db.MessageMetadata, wg *sync.WaitGroup, throttler *rate.Limiter) {
 	for _, message := range messageList.Messages {
+		if ctx.Err() != nil {
+			return
+		}
 		throttler.Wait(context.Background())
-		go getMessageInfo(gmailService, message.Id, messageMetaData, wg)
+		wg.Add(1)
+		go getMessageInfo(progress, gmailService, userId, labelNames, message.Id, messageMetaData, wg)
 	}
 }
 
-func getMessageInfo(gmailService *gmail.Service, id string, messageMetaData chan<- db.MessageMetadata, wg *sync.WaitGroup) {
-	messageListCall := gmailService.Users.Messages.Get("me", id).Format("metadata").MetadataHeaders("From", "To", "Subject", "Date")
+func getMessageInfo(progress *scanProgress, gmailService *gmail.Service, userId string, labelNames map[string]string, id string, messageMetaData chan<- db.MessageMetadata, wg *sync.WaitGroup) {
+	messageListCall := gmailService.Users.Messages.Get(userId, id).Format("metadata").MetadataHeaders("From", "To", "Subject", "Date")
+	release := acquireRequestSlot()
 	message, err := messageListCall.Do()
-	checkError(err)
+	release()
+	if err != nil {
+		failScan(progress.scanId, fmt.Errorf("unable to get message %v: %w", id, err), ErrorCategoryNetwork)
+		progress.markProcessed()
+		wg.Done()
+		return
+	}
 	from := ""
 	to := ""
 	subject := ""
@@ -116,24 +309,39 @@ func getMessageInfo(gmailService *gmail.Service, id string, messageMetaData chan
 		Date:         date,
 		SizeEstimate: message.SizeEstimate,
 	}
-	messageMetaData <- md
-	counter_processed += 1
-	counter_pending -= 1
-	wg.Done()
-}
-
-func logProgressToConsole(done <-chan bool, ticker *time.Ticker) {
-	for {
-		select {
-		case <-done:
-			return
-		case t := <-ticker.C:
-			fmt.Printf("At: %v. Processed= %v, in-progress= %v\n", t, counter_processed, counter_pending)
+	if message.InternalDate > 0 {
+		md.InternalDate = time.UnixMilli(message.InternalDate)
+	}
+	if labelNames != nil {
+		md.LabelNames = make([]string, len(message.LabelIds))
+		for idx, labelId := range message.LabelIds {
+			if name, present := labelNames[labelId]; present {
+				md.LabelNames[idx] = name
+			} else {
+				md.LabelNames[idx] = labelId
+			}
 		}
 	}
+	sendStart := time.Now()
+	messageMetaData <- md
+	progress.sent(sendStart)
+	progress.markProcessed()
+	wg.Done()
 }
 
 type GMailScan struct {
 	Filter       string
 	RefreshToken string
+	// Mailbox to scan. Defaults to "me", the owner of the token.
+	UserId string
+	// Store the label names along with the label ids of each message.
+	FetchLabelNames bool
+	// Destination for the results. See newScanSink for the supported values.
+	Sink string
+	// Continues an earlier gmail scan from its last checkpoint instead of
+	// starting a new scan. The mailbox and filter of the earlier scan are
+	// used, UserId has to be empty or that mailbox, and the token has to be
+	// of the same account. If the
+	// stored page token has expired the scan restarts from the first page.
+	ResumeScanId int
 }
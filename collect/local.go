@@ -1,37 +1,101 @@
 package collect
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/jyothri/hdd/db"
 )
 
-func LocalDrive(localScan LocalScan) int {
+func LocalDrive(localScan LocalScan) (int, error) {
+	sinkSpec, err := parseSinkSpec(localScan.Sink)
+	if err != nil {
+		return 0, asScanError(err, ErrorCategoryValidation)
+	}
+	roots := localScan.roots()
+	if len(roots) == 0 {
+		return 0, &ScanError{Category: ErrorCategoryValidation, Message: "no path to scan"}
+	}
+	if root, nested, overlap := nestedRoot(roots); overlap {
+		return 0, &ScanError{Category: ErrorCategoryValidation, Message: fmt.Sprintf("path %v is under %v, its files would be counted twice", nested, root)}
+	}
+	key := localScanKey(roots)
+	release, err := reserveScanKey(key)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	// A single path is stored as is, so that its scans can be listed by path.
+	searchPath := "dir=" + strings.Join(roots, string(os.PathListSeparator))
+	incrementalFrom := localScan.IncrementalFrom
+	if incrementalFrom != 0 {
+		checkpoint, err := db.GetScanCheckpoint(incrementalFrom)
+		if err != nil {
+			return 0, asScanError(err, ErrorCategoryValidation)
+		}
+		if checkpoint.ScanType != "local" {
+			return 0, asScanError(fmt.Errorf("scanId=%v is not a local scan", incrementalFrom), ErrorCategoryValidation)
+		}
+		// The hashes are only reused for the same paths, so another source
+		// would silently hash every file again.
+		if localScanKey(scannedRoots(checkpoint)) != key {
+			return 0, asScanError(fmt.Errorf("scanId=%v is not a scan of %v", incrementalFrom, strings.Join(roots, ", ")), ErrorCategoryValidation)
+		}
+	} else if localScan.Incremental {
+		incrementalFrom = db.GetLatestCompletedScanId("local", searchPath)
+	}
+	var hashedFiles map[string]db.HashedFile
+	if incrementalFrom != 0 {
+		hashedFiles = db.GetHashedFilesFromDb(incrementalFrom)
+	}
+	sink, err := newScanSink(sinkSpec)
+	if err != nil {
+		return 0, asScanError(err, ErrorCategoryValidation)
+	}
 	scanData := make(chan db.FileData, 10)
 	scanId := db.LogStartScan("local")
-	path := localScan.Path
-	go db.SaveScanMetadata("dir="+path, "", scanId)
-	go startCollectStats(scanId, path, scanData)
-	go db.SaveStatToDb(scanId, scanData)
-	return scanId
+	if incrementalFrom != 0 {
+		fmt.Printf("scanId=%v reuses the hashes of %v files from scanId=%v\n", scanId, len(hashedFiles), incrementalFrom)
+	}
+	db.SaveScanMetadata(searchPath, "", "", scanId)
+	db.SaveScanRoots(scanId, roots)
+	ctx, progress := startScanContext(scanId, key, func() int { return len(scanData) })
+	go startCollectStats(ctx, progress, scanId, localScan, hashedFiles, roots, scanData)
+	go saveFileData(sink, scanId, scanData)
+	return scanId, nil
 }
 
-func startCollectStats(scanId int, parentDir string, scanData chan<- db.FileData) {
+func startCollectStats(ctx context.Context, progress *scanProgress, scanId int, localScan LocalScan, hashedFiles map[string]db.HashedFile, roots []string, scanData chan<- db.FileData) {
 	lock.Lock()
 	defer lock.Unlock()
-	collectStats(parentDir, scanData)
+	ticker := newProgressTicker()
+	done := make(chan bool)
+	go logProgress(progress, done, ticker)
+	for _, root := range roots {
+		if ctx.Err() != nil {
+			break
+		}
+		collectStats(ctx, progress, localScan, hashedFiles, root, root, scanData)
+	}
+	done <- true
+	ticker.Stop()
 	close(scanData)
 }
 
-// Gathers the info for the directory.
+// Gathers the info for the directory under root. Files found in hashedFiles
+// with the same size and modification time are not hashed again.
 // Returns a tuple of (size of the directory, no. of files contained)
-func collectStats(parentDir string, scanData chan<- db.FileData) (int64, int64) {
+func collectStats(ctx context.Context, progress *scanProgress, localScan LocalScan, hashedFiles map[string]db.HashedFile, root string, parentDir string, scanData chan<- db.FileData) (int64, int64) {
 	var directorySize int64
 	var fileCount int64 = 0
 	err := filepath.Walk(parentDir, func(path string, info fs.FileInfo, err error) error {
@@ -45,6 +109,11 @@ func collectStats(parentDir string, scanData chan<- db.FileData) (int64, int64)
 			return nil
 		}
 
+		// Stop traversing once the scan is cancelled.
+		if ctx.Err() != nil {
+			return filepath.SkipDir
+		}
+
 		// Skip hidden files and directories
 		if runtime.GOOS != "windows" && info.Name()[0:1] == "." {
 			// unix/linux file or directory that starts with . is hidden
@@ -57,9 +126,10 @@ func collectStats(parentDir string, scanData chan<- db.FileData) (int64, int64)
 			IsDir:     info.IsDir(),
 			ModTime:   info.ModTime(),
 			FileCount: 1,
+			Root:      root,
 		}
 		if info.IsDir() {
-			ds, fc := collectStats(path, scanData)
+			ds, fc := collectStats(ctx, progress, localScan, hashedFiles, root, path, scanData)
 			directorySize += ds
 			fileCount += fc
 			fd.Size = uint(ds)
@@ -69,9 +139,18 @@ func collectStats(parentDir string, scanData chan<- db.FileData) (int64, int64)
 			fileCount++
 			fd.Size = uint(info.Size())
 			fd.FileCount = 1
-			fd.Md5Hash = getMd5ForFile(path)
+			if hashedFile, present := hashedFiles[path]; present && isUnchanged(hashedFile, info) {
+				fd.Md5Hash = hashedFile.Md5Hash
+			} else if localScan.MaxHashSize > 0 && info.Size() > localScan.MaxHashSize {
+				fd.HashSkipped = true
+			} else {
+				fd.Md5Hash = getMd5ForFile(path)
+			}
 		}
+		sendStart := time.Now()
 		scanData <- fd
+		progress.sent(sendStart)
+		progress.addProcessed()
 		// filepath.Walk works recursively. However our call to
 		// collectStats also performs the traversal recursively.
 		// Returns `filepath.SkipDir` limits to only the files and folders
@@ -85,6 +164,68 @@ func collectStats(parentDir string, scanData chan<- db.FileData) (int64, int64)
 	return directorySize, fileCount
 }
 
+// The modification time is stored in UTC without a time zone and with
+// microsecond precision, so only the UTC wall clock up to the microsecond
+// is compared.
+func isUnchanged(hashedFile db.HashedFile, info fs.FileInfo) bool {
+	const layout = "2006-01-02 15:04:05.000000"
+	modTime := info.ModTime().UTC().Round(time.Microsecond)
+	return hashedFile.Size == info.Size() &&
+		hashedFile.ModifiedTime.Format(layout) == modTime.Format(layout)
+}
+
+// Returns Path followed by Paths cleaned, without empty and repeated paths.
+func (localScan LocalScan) roots() []string {
+	roots := []string{}
+	seen := make(map[string]bool)
+	for _, path := range append([]string{localScan.Path}, localScan.Paths...) {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		path = filepath.Clean(path)
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		roots = append(roots, path)
+	}
+	return roots
+}
+
+// Returns the directories of an earlier local scan, cleaned like roots.
+func scannedRoots(checkpoint db.ScanCheckpoint) []string {
+	paths := []string(checkpoint.Roots)
+	if paths == nil {
+		paths = []string{strings.TrimPrefix(checkpoint.SearchPath.String, "dir=")}
+	}
+	return LocalScan{Paths: paths}.roots()
+}
+
+// Returns the first pair of roots of which one is under the other.
+func nestedRoot(roots []string) (string, string, bool) {
+	for _, root := range roots {
+		prefix := root
+		if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+			prefix += string(filepath.Separator)
+		}
+		for _, other := range roots {
+			if other != root && strings.HasPrefix(other, prefix) {
+				return root, other, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// The roots are sorted, so that the same directories given in a different
+// order are found to be the same source.
+func localScanKey(roots []string) string {
+	paths := append([]string{}, roots...)
+	sort.Strings(paths)
+	return scanKey("local", strings.Join(paths, string(os.PathListSeparator)))
+}
+
 func getMd5ForFile(filePath string) string {
 	file, err := os.Open(filePath)
 	checkError(err)
@@ -97,4 +238,20 @@ func getMd5ForFile(filePath string) string {
 
 type LocalScan struct {
 	Path string
+	// More directories to scan under the same scan. Each file records the
+	// directory it was found under as its root. A path may not be under
+	// another one of the paths.
+	Paths []string
+	// Files larger than this many bytes are recorded without a hash.
+	// 0 hashes every file.
+	MaxHashSize int64
+	// Reuses the hashes of an earlier scan for the files whose path, size and
+	// modification time did not change. IncrementalFrom is the id of that
+	// scan, which has to be of the same directories. With Incremental set
+	// and no IncrementalFrom, the latest completed scan of the same path is
+	// used. All the files are still recorded.
+	Incremental     bool
+	IncrementalFrom int
+	// Destination for the results. See newScanSink for the supported values.
+	Sink string
 }
@@ -1,14 +1,17 @@
 package collect
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,6 +19,7 @@ import (
 
 	"github.com/jyothri/hdd/constants"
 	"github.com/jyothri/hdd/db"
+	"github.com/rwcarlsen/goexif/exif"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/time/rate"
@@ -40,31 +44,57 @@ func getPhotosService(refreshToken string) *http.Client {
 	tokenSrc := oauth2.Token{
 		RefreshToken: refreshToken,
 	}
-	client := photosConfig.Client(context.Background(), &tokenSrc)
+	client := photosConfig.Client(oauthContext(), &tokenSrc)
 	client.Timeout = 10 * time.Second
 	return client
 }
 
-func Photos(photosScan GPhotosScan) int {
+func Photos(photosScan GPhotosScan) (int, error) {
+	sinkSpec, err := parseSinkSpec(photosScan.Sink)
+	if err != nil {
+		return 0, asScanError(err, ErrorCategoryValidation)
+	}
+	photosScan.AlbumId = strings.TrimSpace(photosScan.AlbumId)
+	key := scanKey("photos", accountKey(photosScan.RefreshToken), photosScan.AlbumId)
+	release, err := reserveScanKey(key)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	account := scanAccount(photosScan.RefreshToken)
+	searchPath := ""
+	if photosScan.AlbumId != "" {
+		searchPath = "album=" + photosScan.AlbumId
+		// Fail fast instead of exhausting the retries of listing an invalid album.
+		_, err = GetAlbum(photosScan.RefreshToken, photosScan.AlbumId)
+		if err != nil {
+			return 0, asScanError(err, ErrorCategoryValidation)
+		}
+	}
+	sink, err := newScanSink(sinkSpec)
+	if err != nil {
+		return 0, asScanError(err, ErrorCategoryValidation)
+	}
 	photosMediaItem := make(chan db.PhotosMediaItem, 10)
 	scanId := db.LogStartScan("photos")
-	go db.SaveScanMetadata("", "", scanId)
-	go startPhotosScan(scanId, photosScan, photosMediaItem)
-	go db.SavePhotosMediaItemToDb(scanId, photosMediaItem)
-	return scanId
+	db.SaveScanMetadata(searchPath, "", account, scanId)
+	ctx, progress := startScanContext(scanId, key, func() int { return len(photosMediaItem) })
+	go startPhotosScan(ctx, progress, scanId, photosScan, photosMediaItem)
+	go savePhotosMediaItem(sink, scanId, photosMediaItem)
+	return scanId, nil
 }
 
-func startPhotosScan(scanId int, photosScan GPhotosScan, photosMediaItem chan<- db.PhotosMediaItem) {
+func startPhotosScan(ctx context.Context, progress *scanProgress, scanId int, photosScan GPhotosScan, photosMediaItem chan<- db.PhotosMediaItem) {
 	lock.Lock()
 	defer lock.Unlock()
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := newProgressTicker()
 	done := make(chan bool)
-	go logProgressToConsole(done, ticker)
+	go logProgress(progress, done, ticker)
 	var wg sync.WaitGroup
 	if photosScan.AlbumId != "" {
-		listMediaItemsForAlbum(photosScan, photosMediaItem, &wg)
+		listMediaItemsForAlbum(ctx, progress, scanId, photosScan, photosMediaItem, &wg)
 	} else {
-		listMediaItems(photosScan, photosMediaItem, &wg)
+		listMediaItems(ctx, progress, scanId, photosScan, photosMediaItem, &wg)
 	}
 	wg.Wait()
 	done <- true
@@ -72,14 +102,19 @@ func startPhotosScan(scanId int, photosScan GPhotosScan, photosMediaItem chan<-
 	close(photosMediaItem)
 }
 
-func processMediaItem(photosScan GPhotosScan, mediaItem MediaItem, photosMediaItem chan<- db.PhotosMediaItem, wg *sync.WaitGroup) {
+func processMediaItem(ctx context.Context, progress *scanProgress, photosScan GPhotosScan, mediaItem MediaItem, photosMediaItem chan<- db.PhotosMediaItem, wg *sync.WaitGroup) {
 	defer wg.Done()
 	var size int64 = -1
 	var md5Hash string
-	if photosScan.FetchMd5Hash {
-		size, md5Hash = getContentSizeAndHash(mediaItem.BaseUrl, mediaItem.MimeType)
+	var latitude, longitude db.NullFloat64
+	if photosScan.FetchLocation && strings.HasPrefix(mediaItem.MimeType, "image/") {
+		head := &headBuffer{max: exifHeadSize}
+		size, md5Hash = getContentSizeAndHash(ctx, mediaItem.BaseUrl, mediaItem.MimeType, photosScan.contentRetries(), head)
+		latitude, longitude = getExifLocation(head.Bytes())
+	} else if photosScan.FetchMd5Hash {
+		size, md5Hash = getContentSizeAndHash(ctx, mediaItem.BaseUrl, mediaItem.MimeType, photosScan.contentRetries(), nil)
 	} else if photosScan.FetchSize {
-		size = getContentSize(mediaItem.BaseUrl, mediaItem.MimeType)
+		size = getContentSize(ctx, mediaItem.BaseUrl, mediaItem.MimeType, photosScan.contentRetries())
 	}
 	var cameraMake string
 	var cameraModel string
@@ -88,7 +123,7 @@ func processMediaItem(photosScan GPhotosScan, mediaItem MediaItem, photosMediaIt
 	var focalLength float32
 	var iso int
 	var fps float32
-	if mediaItem.MimeType[:5] == "image" {
+	if strings.HasPrefix(mediaItem.MimeType, "image/") {
 		cameraMake = mediaItem.MediaMetadata.Photo.CameraMake
 		cameraModel = mediaItem.MediaMetadata.Photo.CameraModel
 		fNumber = mediaItem.MediaMetadata.Photo.ApertureFNumber
@@ -107,6 +142,7 @@ func processMediaItem(photosScan GPhotosScan, mediaItem MediaItem, photosMediaIt
 		Filename:               mediaItem.Filename,
 		Size:                   size,
 		ContributorDisplayName: mediaItem.ContributorInfo.DisplayName,
+		ContributorProfileUrl:  mediaItem.ContributorInfo.ProfilePictureBaseUrl,
 		CameraMake:             cameraMake,
 		CameraModel:            cameraModel,
 		FocalLength:            focalLength,
@@ -115,6 +151,8 @@ func processMediaItem(photosScan GPhotosScan, mediaItem MediaItem, photosMediaIt
 		ExposureTime:           exposureTime,
 		Fps:                    fps,
 		Md5hash:                md5Hash,
+		Latitude:               latitude,
+		Longitude:              longitude,
 	}
 	layout := "2006-01-02T15:04:05Z"
 	str := mediaItem.MediaMetadata.CreationTime
@@ -126,33 +164,55 @@ func processMediaItem(photosScan GPhotosScan, mediaItem MediaItem, photosMediaIt
 		fmt.Printf("err parsing time. err=%v\n", err)
 	}
 
+	sendStart := time.Now()
 	photosMediaItem <- pmi
-	counter_processed += 1
-	counter_pending -= 1
+	progress.sent(sendStart)
+	progress.markProcessed()
 }
 
-func ListAlbums(refreshToken string) []Album {
+// Lists the albums of the account. At most maxAlbums albums are fetched,
+// 0 fetches all of them. Also returns whether there are more albums than
+// the ones returned.
+func ListAlbums(refreshToken string, maxAlbums int) ([]Album, bool) {
+	// Most albums the API returns in a page.
+	const albumsPageSize = 50
+	pageSize := albumsPageSize
+	if maxAlbums > 0 && maxAlbums < pageSize {
+		pageSize = maxAlbums
+	}
 	albums := make([]Album, 0)
 	url := photosApiBaseUrl + "v1/albums"
 	nextPageToken := ""
 	hasNextPage := true
 	client := getPhotosService(refreshToken)
 	for hasNextPage {
+		if maxAlbums > 0 && len(albums) >= maxAlbums {
+			return albums[:maxAlbums], true
+		}
 		err := throttler.Wait(context.Background())
 		checkError(err, fmt.Sprintf("Error with limiter: %s", err))
-		nextPageUrl := url + "?pageToken=" + nextPageToken
+		nextPageUrl := fmt.Sprintf("%v?pageSize=%v&pageToken=%v", url, pageSize, nextPageToken)
 		req, err := http.NewRequest("GET", nextPageUrl, nil)
 		checkError(err)
+		release := acquireRequestSlot()
 		resp, err := client.Do(req)
-		checkError(err)
+		if err != nil {
+			// The slot has to be released before the panic, it would be lost
+			// for good otherwise.
+			release()
+			checkError(err)
+		}
 		if resp.StatusCode != 200 {
 			fmt.Printf("Unexpected response status code %v\n", resp.StatusCode)
 			rb, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
 			fmt.Printf("Response %v\n", string(rb))
-			return albums
+			release()
+			return albums, false
 		}
 		albumResponse := new(ListAlbumsResponse)
 		err = getJson(resp, albumResponse)
+		release()
 		checkError(err)
 		nextPageToken = albumResponse.NextPageToken
 		albums = append(albums, albumResponse.Albums...)
@@ -160,16 +220,54 @@ func ListAlbums(refreshToken string) []Album {
 			hasNextPage = false
 		}
 	}
-	return albums
+	if maxAlbums > 0 && len(albums) > maxAlbums {
+		return albums[:maxAlbums], true
+	}
+	return albums, false
 }
 
-func listMediaItemsForAlbum(photosScan GPhotosScan, photosMediaItem chan<- db.PhotosMediaItem, wg *sync.WaitGroup) {
-	var retries int = 25
+// Retrieves the album with albumId. An error is returned if there is no such
+// album accessible with the token.
+func GetAlbum(refreshToken string, albumId string) (Album, error) {
+	album := Album{}
+	err := throttler.Wait(context.Background())
+	checkError(err, fmt.Sprintf("Error with limiter: %s", err))
+	albumUrl := photosApiBaseUrl + "v1/albums/" + url.PathEscape(albumId)
+	req, err := http.NewRequest("GET", albumUrl, nil)
+	checkError(err)
+	client := getPhotosService(refreshToken)
+	release := acquireRequestSlot()
+	defer release()
+	resp, err := client.Do(req)
+	if err != nil {
+		return album, asScanError(fmt.Errorf("unable to get album %q: %w", albumId, err), ErrorCategoryNetwork)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = getJson(resp, &album)
+		return album, err
+	case http.StatusBadRequest, http.StatusNotFound:
+		resp.Body.Close()
+		return album, &ScanError{Category: ErrorCategoryValidation, Message: fmt.Sprintf("invalid album id %q", albumId)}
+	default:
+		rb, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return album, &ScanError{
+			Category: categorizeStatus(resp.StatusCode, nil, ErrorCategoryNetwork),
+			Message:  fmt.Sprintf("unable to get album %q. status code %v. response %v", albumId, resp.StatusCode, string(rb)),
+		}
+	}
+}
+
+func listMediaItemsForAlbum(ctx context.Context, progress *scanProgress, scanId int, photosScan GPhotosScan, photosMediaItem chan<- db.PhotosMediaItem, wg *sync.WaitGroup) {
+	retries := newPageRetries(photosScan.listRetries())
+	itemsProcessed := 0
 	url := photosApiBaseUrl + "v1/mediaItems:search"
 	nextPageToken := ""
+	requestedPageTokens := make(map[string]bool)
 	hasNextPage := true
 	client := getPhotosService(photosScan.RefreshToken)
-	for hasNextPage {
+	for hasNextPage && ctx.Err() == nil {
 		err := throttler.Wait(context.Background())
 		checkError(err, fmt.Sprintf("Error with limiter: %s", err))
 		nextPageUrl := url + "?pageToken=" + nextPageToken
@@ -179,159 +277,342 @@ func listMediaItemsForAlbum(photosScan GPhotosScan, photosMediaItem chan<- db.Ph
 		reqBody := strings.NewReader(string(reqJson))
 		req, err := http.NewRequest("POST", nextPageUrl, reqBody)
 		checkError(err)
-		resp, err := client.Do(req)
-		checkError(err)
-		if resp.StatusCode != 200 {
-			fmt.Printf("Unexpected response status code %v", resp.StatusCode)
-			rb, _ := io.ReadAll(resp.Body)
-			fmt.Printf("Response %v\n", string(rb))
-			if retries == 0 {
+		release := acquireRequestSlot()
+		listMediaItemResponse, err := getMediaItemsPage(client, req)
+		release()
+		if err != nil {
+			fmt.Printf("Listing media items of scanId=%v failed. err=%v\n", scanId, err)
+			// Authorization errors do not go away on retry.
+			backoff, ok := retries.failed()
+			if !ok || categorize(err, ErrorCategoryNetwork) == ErrorCategoryAuth {
+				stopPartialScan(scanId, nextPageToken, itemsProcessed, err)
 				return
 			}
-			retries -= 1
+			sleepContext(ctx, backoff)
 			continue
 		}
-		listMediaItemResponse := new(ListMediaItemResponse)
-		err = getJson(resp, listMediaItemResponse)
-		checkError(err)
+		retries.succeeded()
+		requestedPageTokens[nextPageToken] = true
 		nextPageToken = listMediaItemResponse.NextPageToken
-		wg.Add(len(listMediaItemResponse.MediaItems))
-		counter_pending += len(listMediaItemResponse.MediaItems)
+		progress.addPending(len(listMediaItemResponse.MediaItems))
+		itemsProcessed += len(listMediaItemResponse.MediaItems)
 		for _, mediaItem := range listMediaItemResponse.MediaItems {
+			if ctx.Err() != nil {
+				break
+			}
 			err := throttler.Wait(context.Background())
 			checkError(err, fmt.Sprintf("Error with limiter: %s", err))
-			processMediaItem(photosScan, mediaItem, photosMediaItem, wg)
+			wg.Add(1)
+			processMediaItem(ctx, progress, photosScan, mediaItem, photosMediaItem, wg)
 		}
 		if len(nextPageToken) == 0 {
 			hasNextPage = false
+		} else if requestedPageTokens[nextPageToken] {
+			stopRepeatedPageToken(scanId, itemsProcessed)
+			hasNextPage = false
 		}
 	}
 }
 
-func listMediaItems(photosScan GPhotosScan, photosMediaItem chan<- db.PhotosMediaItem, wg *sync.WaitGroup) {
-	var retries int = 25
+func listMediaItems(ctx context.Context, progress *scanProgress, scanId int, photosScan GPhotosScan, photosMediaItem chan<- db.PhotosMediaItem, wg *sync.WaitGroup) {
+	retries := newPageRetries(photosScan.listRetries())
+	itemsProcessed := 0
 	url := photosApiBaseUrl + "v1/mediaItems"
 	nextPageToken := ""
+	requestedPageTokens := make(map[string]bool)
 	hasNextPage := true
 	client := getPhotosService(photosScan.RefreshToken)
-	for hasNextPage {
+	for hasNextPage && ctx.Err() == nil {
 		err := throttler.Wait(context.Background())
 		checkError(err, fmt.Sprintf("Error with limiter: %s", err))
 		nextPageUrl := url + "?pageToken=" + nextPageToken
 		req, err := http.NewRequest("GET", nextPageUrl, nil)
 		checkError(err)
-		resp, err := client.Do(req)
-		checkError(err)
-		if resp.StatusCode != 200 {
-			fmt.Printf("Unexpected response status code %v", resp.StatusCode)
-			rb, _ := io.ReadAll(resp.Body)
-			fmt.Printf("Response %v\n", string(rb))
-			if retries == 0 {
+		release := acquireRequestSlot()
+		listMediaItemResponse, err := getMediaItemsPage(client, req)
+		release()
+		if err != nil {
+			fmt.Printf("Listing media items of scanId=%v failed. err=%v\n", scanId, err)
+			// Authorization errors do not go away on retry.
+			backoff, ok := retries.failed()
+			if !ok || categorize(err, ErrorCategoryNetwork) == ErrorCategoryAuth {
+				stopPartialScan(scanId, nextPageToken, itemsProcessed, err)
 				return
 			}
-			retries -= 1
+			sleepContext(ctx, backoff)
 			continue
 		}
-		listMediaItemResponse := new(ListMediaItemResponse)
-		err = getJson(resp, listMediaItemResponse)
-		checkError(err)
+		retries.succeeded()
+		requestedPageTokens[nextPageToken] = true
 		nextPageToken = listMediaItemResponse.NextPageToken
-		wg.Add(len(listMediaItemResponse.MediaItems))
-		counter_pending += len(listMediaItemResponse.MediaItems)
+		progress.addPending(len(listMediaItemResponse.MediaItems))
+		itemsProcessed += len(listMediaItemResponse.MediaItems)
 		for _, mediaItem := range listMediaItemResponse.MediaItems {
+			if ctx.Err() != nil {
+				break
+			}
 			err := throttler.Wait(context.Background())
 			checkError(err, fmt.Sprintf("Error with limiter: %s", err))
-			processMediaItem(photosScan, mediaItem, photosMediaItem, wg)
+			wg.Add(1)
+			processMediaItem(ctx, progress, photosScan, mediaItem, photosMediaItem, wg)
 		}
 		if len(nextPageToken) == 0 {
 			hasNextPage = false
+		} else if requestedPageTokens[nextPageToken] {
+			stopRepeatedPageToken(scanId, itemsProcessed)
+			hasNextPage = false
 		}
 	}
 }
 
-func getContentSizeAndHash(url string, mimeType string) (int64, string) {
-	var retries int = 5
+// Retries of listing a page of media items. Every page which is listed
+// restores the retries, so only consecutive failures use them up and the
+// backoff restarts from the first attempt.
+type pageRetries struct {
+	max  int
+	left int
+}
+
+func newPageRetries(max int) *pageRetries {
+	return &pageRetries{max: max, left: max}
+}
+
+// Returns the backoff before listing the page again, or false once the
+// retries are used up.
+func (r *pageRetries) failed() (time.Duration, bool) {
+	if r.left == 0 {
+		return 0, false
+	}
+	backoff := retryBackoff(r.max - r.left)
+	r.left--
+	return backoff, true
+}
+
+func (r *pageRetries) succeeded() {
+	r.left = r.max
+}
+
+// Fetches a page of media items. Failed requests are returned as a
+// ScanError with the category of the status code.
+func getMediaItemsPage(client *http.Client, req *http.Request) (*ListMediaItemResponse, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		rb, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, &ScanError{
+			Category: categorizeStatus(resp.StatusCode, nil, ErrorCategoryNetwork),
+			Message:  fmt.Sprintf("unexpected status code %v. response %v", resp.StatusCode, string(rb)),
+		}
+	}
+	listMediaItemResponse := new(ListMediaItemResponse)
+	err = getJson(resp, listMediaItemResponse)
+	if err != nil {
+		return nil, asScanError(err, ErrorCategoryNetwork)
+	}
+	return listMediaItemResponse, nil
+}
+
+// Keeps the media items fetched so far when listing gives up, so the scan
+// completes with a warning. The page token which could not be fetched is
+// recorded to allow continuing the scan later, and the category of err is
+// recorded along with the warning.
+func stopPartialScan(scanId int, nextPageToken string, itemsProcessed int, err error) {
+	category := categorize(err, ErrorCategoryNetwork)
+	fmt.Printf("Giving up listing media items for scanId=%v after %v items. category=%v err=%v\n", scanId, itemsProcessed, category, err)
+	db.SaveScanCheckpoint(scanId, nextPageToken, itemsProcessed)
+	db.LogScanWarningWithCategory(scanId, string(category), fmt.Sprintf("Listing media items stopped after exhausting retries. "+
+		"Scan is partial with %v media items. err=%v", itemsProcessed, err))
+}
+
+// The API can return pages, often empty ones, which point back to a page
+// already fetched. Following those would never end the listing.
+func stopRepeatedPageToken(scanId int, itemsProcessed int) {
+	fmt.Printf("Stopped listing media items for scanId=%v after %v items. Next page token was already fetched.\n", scanId, itemsProcessed)
+	db.LogScanWarning(scanId, fmt.Sprintf("Listing media items stopped as the next page token repeated. "+
+		"Scan may be partial with %v media items.", itemsProcessed))
+}
+
+// Downloads the content to compute its size and md5 hash. When head is set,
+// the leading bytes of the content are also copied into it. The retries stop
+// once ctx is done.
+func getContentSizeAndHash(ctx context.Context, url string, mimeType string, retries int, head io.Writer) (int64, string) {
 	var resp *http.Response
 	var err error
-	switch mimeType[:5] {
-	case "image":
-		//e.g. image/jpeg image/png image/gif
-		url = url + "=d"
-	case "video":
-		//e.g. video/mp4
-		url = url + "=dv"
-	default:
-		fmt.Printf("Unhandled mime type: %v\n", mimeType)
-	}
-	for retries > 0 {
-		resp, err = http.Get(url)
-		if err != nil {
-			fmt.Printf("Got error:%v. Will retry %v times\n", err, retries)
-			retries -= 1
-			continue
+	url = getDownloadUrl(url, mimeType)
+	// Slot is held until the content is fully read.
+	release := acquireRequestSlot()
+	defer release()
+	for attempt := 0; ; attempt++ {
+		resp, err = userAgentClient.Get(url)
+		if err == nil && resp.StatusCode == 200 {
+			break
 		}
-		if resp.StatusCode != 200 {
+		if err != nil {
+			fmt.Printf("Got error:%v.\n", err)
+		} else {
 			fmt.Printf("Unexpected response status code %v", resp.StatusCode)
 			rb, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
 			fmt.Printf("Response %v\n", string(rb))
-			fmt.Printf("Will retry %v times\n", retries)
-			retries -= 1
 		}
-		break
+		if attempt >= retries {
+			break
+		}
+		fmt.Printf("Will retry %v times\n", retries-attempt)
+		if !sleepContext(ctx, retryBackoff(attempt)) {
+			break
+		}
 	}
-	if resp == nil || resp.StatusCode != 200 {
+	if err != nil || resp.StatusCode != 200 {
 		return 0, ""
 	}
 	defer resp.Body.Close()
-	contentLength, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
-	checkError(err)
-
 	hash := md5.New()
-	_, err = io.Copy(ioutil.Discard, io.TeeReader(resp.Body, hash))
-	checkError(err)
+	var writer io.Writer = hash
+	if head != nil {
+		writer = io.MultiWriter(hash, head)
+	}
+	// The size is counted as the content is read, the Content-Length header
+	// is not always set.
+	contentLength, err := io.Copy(ioutil.Discard, io.TeeReader(resp.Body, writer))
+	if err != nil {
+		fmt.Printf("Unable to download the content of %v. err=%v\n", url, err)
+		return 0, ""
+	}
 	return contentLength, hex.EncodeToString(hash.Sum(nil))
 }
 
-func getContentSize(url string, mimeType string) int64 {
-	var retries int = 5
+// EXIF data is stored at the start of the image. Only these many bytes are
+// retained from the download to look for it.
+const exifHeadSize = 256 * 1024
+
+// Retains the first max bytes written to it and discards the rest.
+type headBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if remaining := b.max - b.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.Buffer.Write(p[:remaining])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Extracts the GPS coordinates from the EXIF data of an image. The location is
+// not set when the image has no EXIF GPS tags, which is common for downloads.
+func getExifLocation(image []byte) (db.NullFloat64, db.NullFloat64) {
+	x, err := exif.Decode(bytes.NewReader(image))
+	if err != nil {
+		return db.NullFloat64{}, db.NullFloat64{}
+	}
+	lat, long, err := x.LatLong()
+	if err != nil {
+		return db.NullFloat64{}, db.NullFloat64{}
+	}
+	return db.NullFloat64{NullFloat64: sql.NullFloat64{Float64: lat, Valid: true}},
+		db.NullFloat64{NullFloat64: sql.NullFloat64{Float64: long, Valid: true}}
+}
+
+func getContentSize(ctx context.Context, url string, mimeType string, retries int) int64 {
 	var resp *http.Response
 	var err error
-	switch mimeType[:5] {
-	case "image":
-		//e.g. image/jpeg image/png image/gif
-		url = url + "=d"
-	case "video":
-		//e.g. video/mp4
-		url = url + "=dv"
-	default:
-		fmt.Printf("Unhandled mime type: %v\n", mimeType)
-	}
-	for retries > 0 {
-		resp, err = http.Head(url)
-		if err != nil {
-			fmt.Printf("Got error:%v. Will retry %v times\n", err, retries)
-			retries -= 1
-			continue
+	url = getDownloadUrl(url, mimeType)
+	// Slot is held until the content is fully read.
+	release := acquireRequestSlot()
+	defer release()
+	for attempt := 0; ; attempt++ {
+		resp, err = userAgentClient.Head(url)
+		if err == nil && resp.StatusCode == 200 {
+			break
 		}
-		if resp.StatusCode != 200 {
+		if err != nil {
+			fmt.Printf("Got error:%v.\n", err)
+		} else {
 			fmt.Printf("Unexpected response status code %v", resp.StatusCode)
 			rb, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
 			fmt.Printf("Response %v\n", string(rb))
-			fmt.Printf("Will retry %v times\n", retries)
-			retries -= 1
 		}
-		break
+		if attempt >= retries {
+			break
+		}
+		fmt.Printf("Will retry %v times\n", retries-attempt)
+		if !sleepContext(ctx, retryBackoff(attempt)) {
+			break
+		}
 	}
-	if resp == nil || resp.StatusCode != 200 {
+	if err != nil || resp.StatusCode != 200 {
 		return 0
 	}
 	defer resp.Body.Close()
-	contentLength, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
-	checkError(err)
 	io.Copy(ioutil.Discard, resp.Body)
+	contentLength, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		fmt.Printf("Invalid Content-Length of %v. err=%v\n", url, err)
+		return 0
+	}
 	return contentLength
 }
 
+// Url to download the content of the media item with baseUrl.
+func getDownloadUrl(baseUrl string, mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		//e.g. image/jpeg image/png image/gif
+		return baseUrl + "=d"
+	case strings.HasPrefix(mimeType, "video/"):
+		//e.g. video/mp4
+		return baseUrl + "=dv"
+	default:
+		fmt.Printf("Unhandled mime type: %v\n", mimeType)
+		return baseUrl
+	}
+}
+
+// Returns the url to download the media item with. Base urls expire after a
+// while, so a fresh one is fetched every time.
+func GetMediaItemDownloadUrl(refreshToken string, mediaItemId string) (string, error) {
+	err := throttler.Wait(context.Background())
+	checkError(err, fmt.Sprintf("Error with limiter: %s", err))
+	mediaItemUrl := photosApiBaseUrl + "v1/mediaItems/" + url.PathEscape(mediaItemId)
+	req, err := http.NewRequest("GET", mediaItemUrl, nil)
+	checkError(err)
+	client := getPhotosService(refreshToken)
+	release := acquireRequestSlot()
+	defer release()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", asScanError(fmt.Errorf("unable to get media item %q: %w", mediaItemId, err), ErrorCategoryNetwork)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		mediaItem := MediaItem{}
+		err = getJson(resp, &mediaItem)
+		if err != nil {
+			return "", asScanError(err, ErrorCategoryNetwork)
+		}
+		return getDownloadUrl(mediaItem.BaseUrl, mediaItem.MimeType), nil
+	case http.StatusBadRequest, http.StatusNotFound:
+		resp.Body.Close()
+		return "", &ScanError{Category: ErrorCategoryValidation, Message: fmt.Sprintf("invalid media item id %q", mediaItemId)}
+	default:
+		rb, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return "", &ScanError{
+			Category: categorizeStatus(resp.StatusCode, nil, ErrorCategoryNetwork),
+			Message:  fmt.Sprintf("unable to get media item %q. status code %v. response %v", mediaItemId, resp.StatusCode, string(rb)),
+		}
+	}
+}
+
 func getJson(r *http.Response, target interface{}) error {
 	defer r.Body.Close()
 	return json.NewDecoder(r.Body).Decode(target)
@@ -408,5 +689,28 @@ type GPhotosScan struct {
 	AlbumId      string
 	FetchSize    bool
 	FetchMd5Hash bool
-	RefreshToken string
+	// Extract the GPS location from the EXIF data of photos. This downloads
+	// the photos, so their size and md5 hash are stored as well.
+	FetchLocation bool
+	RefreshToken  string
+	// Number of times a failed request is retried. When not set the values
+	// of the photos_list_retries and photos_content_retries flags are used.
+	ListRetries    int
+	ContentRetries int
+	// Destination for the results. See newScanSink for the supported values.
+	Sink string
+}
+
+func (photosScan GPhotosScan) listRetries() int {
+	if photosScan.ListRetries > 0 {
+		return photosScan.ListRetries
+	}
+	return constants.PhotosListRetries
+}
+
+func (photosScan GPhotosScan) contentRetries() int {
+	if photosScan.ContentRetries > 0 {
+		return photosScan.ContentRetries
+	}
+	return constants.PhotosContentRetries
 }
@@ -0,0 +1,28 @@
+package collect
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPageRetriesRestoredByListedPage(t *testing.T) {
+	retries := newPageRetries(2)
+	for i, want := range []time.Duration{time.Second, 2 * time.Second} {
+		backoff, ok := retries.failed()
+		if !ok || backoff != want {
+			t.Fatalf("failure %v: got backoff %v ok %v, want %v", i+1, backoff, ok, want)
+		}
+	}
+	retries.succeeded()
+	// Failures separated by a listed page are not consecutive, the backoff
+	// starts over and the retries are available again.
+	for i, want := range []time.Duration{time.Second, 2 * time.Second} {
+		backoff, ok := retries.failed()
+		if !ok || backoff != want {
+			t.Fatalf("failure %v after a listed page: got backoff %v ok %v, want %v", i+1, backoff, ok, want)
+		}
+	}
+	if _, ok := retries.failed(); ok {
+		t.Fatal("retried after the retries were used up")
+	}
+}
@@ -0,0 +1,147 @@
+package collect
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jyothri/hdd/constants"
+)
+
+// Progress of a scan. Published under the scanId while the scan runs and
+// once more with Completed set when it finishes.
+type Progress struct {
+	ScanId    int   `json:"scan_id"`
+	Processed int64 `json:"processed"`
+	Pending   int64 `json:"pending"`
+	// Items waiting to be written by the sink, and the number of times the
+	// collector waited longer than channel_block_threshold for room among
+	// them. A growing count means the database is the bottleneck.
+	QueueDepth   int   `json:"queue_depth"`
+	BlockedSends int64 `json:"blocked_sends"`
+	Completed    bool  `json:"completed"`
+}
+
+// Counters of a running scan. Updated concurrently by the collectors.
+type scanProgress struct {
+	scanId    int
+	processed int64
+	pending   int64
+	// Sends to the sink which blocked past the threshold and the total time
+	// spent in them.
+	blockedSends int64
+	blockedTime  int64
+	queueLength  func() int
+}
+
+// Records items which are listed but not processed yet.
+func (p *scanProgress) addPending(count int) {
+	atomic.AddInt64(&p.pending, int64(count))
+}
+
+// Records an item which was listed earlier as processed.
+func (p *scanProgress) markProcessed() {
+	atomic.AddInt64(&p.processed, 1)
+	atomic.AddInt64(&p.pending, -1)
+}
+
+// Records an item which is processed as soon as it is found.
+func (p *scanProgress) addProcessed() {
+	atomic.AddInt64(&p.processed, 1)
+}
+
+// Records a send to the channel of the sink which started at start.
+func (p *scanProgress) sent(start time.Time) {
+	waited := time.Since(start)
+	if waited > constants.ChannelBlockThreshold {
+		atomic.AddInt64(&p.blockedSends, 1)
+		atomic.AddInt64(&p.blockedTime, int64(waited))
+	}
+}
+
+func (p *scanProgress) snapshot() Progress {
+	progress := Progress{
+		ScanId:       p.scanId,
+		Processed:    atomic.LoadInt64(&p.processed),
+		Pending:      atomic.LoadInt64(&p.pending),
+		BlockedSends: atomic.LoadInt64(&p.blockedSends),
+	}
+	if p.queueLength != nil {
+		progress.QueueDepth = p.queueLength()
+	}
+	return progress
+}
+
+// Subscribers mapped to the scanId they are interested in. 0 stands for all scans.
+var progressSubscribers = struct {
+	sync.Mutex
+	subscribers map[chan Progress]int
+}{subscribers: make(map[chan Progress]int)}
+
+// Subscribes to the progress of the scan with scanId or of all the scans when
+// scanId is 0. The returned func must be invoked to unsubscribe.
+func SubscribeProgress(scanId int) (<-chan Progress, func()) {
+	subscriber := make(chan Progress, 10)
+	progressSubscribers.Lock()
+	progressSubscribers.subscribers[subscriber] = scanId
+	progressSubscribers.Unlock()
+	return subscriber, func() {
+		progressSubscribers.Lock()
+		delete(progressSubscribers.subscribers, subscriber)
+		progressSubscribers.Unlock()
+	}
+}
+
+// Slow subscribers miss updates instead of blocking the scan.
+func publishProgress(progress Progress) {
+	progressSubscribers.Lock()
+	defer progressSubscribers.Unlock()
+	for subscriber, scanId := range progressSubscribers.subscribers {
+		if scanId != 0 && scanId != progress.ScanId {
+			continue
+		}
+		select {
+		case subscriber <- progress:
+		default:
+		}
+	}
+}
+
+func newProgressTicker() *time.Ticker {
+	return time.NewTicker(progressInterval())
+}
+
+func progressInterval() time.Duration {
+	if constants.ProgressInterval <= 0 {
+		return 5 * time.Second
+	}
+	return constants.ProgressInterval
+}
+
+// Logs and publishes the progress of the scan right away and then on every
+// tick until done. Also logs when the collector was held up by the sink since
+// the previous tick.
+func logProgress(progress *scanProgress, done <-chan bool, ticker *time.Ticker) {
+	var reportedSends, reportedTime int64
+	report := func(t time.Time) {
+		snapshot := progress.snapshot()
+		fmt.Printf("At: %v. scanId= %v, Processed= %v, in-progress= %v, queued= %v\n", t, snapshot.ScanId, snapshot.Processed, snapshot.Pending, snapshot.QueueDepth)
+		blockedTime := atomic.LoadInt64(&progress.blockedTime)
+		if snapshot.BlockedSends > reportedSends {
+			fmt.Printf("scanId= %v waited %v on the database in %v sends since the last report\n", snapshot.ScanId,
+				time.Duration(blockedTime-reportedTime).Round(time.Millisecond), snapshot.BlockedSends-reportedSends)
+			reportedSends, reportedTime = snapshot.BlockedSends, blockedTime
+		}
+		publishProgress(snapshot)
+	}
+	report(time.Now())
+	for {
+		select {
+		case <-done:
+			return
+		case t := <-ticker.C:
+			report(t)
+		}
+	}
+}
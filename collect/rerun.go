@@ -0,0 +1,92 @@
+package collect
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jyothri/hdd/constants"
+	"github.com/jyothri/hdd/db"
+)
+
+// An earlier scan to start again. RefreshToken is the current token of the
+// account for the scans of Google accounts, it is ignored otherwise.
+type Rerun struct {
+	ScanId       int
+	RefreshToken string
+}
+
+type RerunResult struct {
+	ScanId    int
+	NewScanId int
+	Err       error
+}
+
+// Starts a new scan of the same source as scanId, i.e. the directories, bucket,
+// query, filter or album which it recorded. The other options of the earlier
+// scan are not stored, so their defaults are used.
+func RerunScan(scanId int, refreshToken string) (int, error) {
+	checkpoint, err := db.GetScanCheckpoint(scanId)
+	if err != nil {
+		return 0, asScanError(err, ErrorCategoryValidation)
+	}
+	searchPath := checkpoint.SearchPath.String
+	searchFilter := checkpoint.SearchFilter.String
+	switch checkpoint.ScanType {
+	case "local":
+		return LocalDrive(LocalScan{Paths: scannedRoots(checkpoint)})
+	case "google_storage":
+		return CloudStorage(GStorageScan{Bucket: strings.TrimPrefix(searchPath, "bucket=")})
+	}
+	if refreshToken == "" {
+		return 0, &ScanError{Category: ErrorCategoryValidation, Message: fmt.Sprintf("refresh token is required to rerun scanId=%v", scanId)}
+	}
+	switch checkpoint.ScanType {
+	case "google_drive":
+		return CloudDrive(GDriveScan{QueryString: searchFilter, RefreshToken: refreshToken})
+	case "gmail":
+		// The scans recorded before the mailbox was stored may have been of a
+		// delegated mailbox. Rerunning them on the own mailbox of the token
+		// would silently scan something else.
+		if !strings.HasPrefix(searchPath, "mailbox=") {
+			return 0, &ScanError{Category: ErrorCategoryValidation, Message: fmt.Sprintf("mailbox of scanId=%v is unknown, start a new scan instead", scanId)}
+		}
+		return Gmail(GMailScan{Filter: searchFilter, RefreshToken: refreshToken, UserId: strings.TrimPrefix(searchPath, "mailbox=")})
+	case "photos":
+		return Photos(GPhotosScan{AlbumId: strings.TrimPrefix(searchPath, "album="), RefreshToken: refreshToken})
+	}
+	return 0, &ScanError{Category: ErrorCategoryValidation, Message: fmt.Sprintf("scanId=%v of type %v can not be rerun", scanId, checkpoint.ScanType)}
+}
+
+// Reruns the scans, at most rerun_concurrency of them being started at a
+// time. Starting a scan can call the APIs, e.g. to check the album of a photos
+// scan, and the scans themselves run one after the other. The results are in
+// the order of reruns.
+func RerunScans(reruns []Rerun) []RerunResult {
+	results := make([]RerunResult, len(reruns))
+	concurrency := constants.RerunConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for i, rerun := range reruns {
+		wg.Add(1)
+		slots <- true
+		go func(i int, rerun Rerun) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			// The database helpers panic on errors, which would otherwise
+			// bring down the server from this goroutine.
+			defer func() {
+				if r := recover(); r != nil {
+					results[i] = RerunResult{ScanId: rerun.ScanId, Err: &ScanError{Category: ErrorCategoryDB, Message: fmt.Sprint(r)}}
+				}
+			}()
+			newScanId, err := RerunScan(rerun.ScanId, rerun.RefreshToken)
+			results[i] = RerunResult{ScanId: rerun.ScanId, NewScanId: newScanId, Err: err}
+		}(i, rerun)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,168 @@
+package collect
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jyothri/hdd/db"
+)
+
+type runningScan struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	progress *scanProgress
+	key      string
+	// Set by failScan.
+	failed bool
+}
+
+// A scan holding a key. scanId is 0 until the scan is registered.
+type scanReservation struct {
+	scanId int
+}
+
+// Scans which are in progress keyed by the scanId. A scan stays registered
+// until all its results are written to the sink. The scans are also keyed by
+// their source, see scanKey, so that the same source is not scanned twice at
+// the same time.
+var runningScans = struct {
+	sync.Mutex
+	scans map[int]runningScan
+	keys  map[string]*scanReservation
+}{scans: make(map[int]runningScan), keys: make(map[string]*scanReservation)}
+
+// Identifies the source of a scan. The refresh token is hashed so that it is
+// not kept around in memory, see accountKey.
+func scanKey(scanType string, params ...string) string {
+	return scanType + ":" + strings.Join(params, ":")
+}
+
+// Tells the accounts of the running scans apart by their refresh token,
+// without calling an API before the scan is reserved. Two tokens of the same
+// account are taken as different accounts. The stored scans are identified by
+// accountEmail instead.
+func accountKey(refreshToken string) string {
+	hash := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(hash[:8])
+}
+
+// Reserves key for a scan which is about to start. Fails with a
+// DuplicateScanError when a scan with the same key is running. The returned
+// func frees the key unless a scan was registered with it by
+// startScanContext, it is then freed once that scan finishes.
+func reserveScanKey(key string) (func(), error) {
+	runningScans.Lock()
+	defer runningScans.Unlock()
+	if reservation, present := runningScans.keys[key]; present {
+		return nil, &DuplicateScanError{ScanId: reservation.scanId}
+	}
+	reservation := &scanReservation{}
+	runningScans.keys[key] = reservation
+	return func() {
+		runningScans.Lock()
+		defer runningScans.Unlock()
+		if runningScans.keys[key] == reservation && reservation.scanId == 0 {
+			delete(runningScans.keys, key)
+		}
+	}, nil
+}
+
+// Registers a scan as running. The returned context is done once the
+// scan is cancelled. Collectors check it between API calls and stop early.
+// The returned progress is published under the scanId. key is the one
+// reserved for the scan with reserveScanKey. queueLength returns the number
+// of items waiting in the channel to the sink.
+func startScanContext(scanId int, key string, queueLength func() int) (context.Context, *scanProgress) {
+	ctx, cancel := context.WithCancel(context.Background())
+	progress := &scanProgress{scanId: scanId, queueLength: queueLength}
+	runningScans.Lock()
+	defer runningScans.Unlock()
+	runningScans.scans[scanId] = runningScan{ctx: ctx, cancel: cancel, progress: progress, key: key}
+	if reservation, present := runningScans.keys[key]; present {
+		reservation.scanId = scanId
+	}
+	return ctx, progress
+}
+
+func finishScanContext(scanId int) {
+	runningScans.Lock()
+	defer runningScans.Unlock()
+	if scan, present := runningScans.scans[scanId]; present {
+		scan.cancel()
+		delete(runningScans.scans, scanId)
+		if reservation, present := runningScans.keys[scan.key]; present && reservation.scanId == scanId {
+			delete(runningScans.keys, scan.key)
+		}
+		progress := scan.progress.snapshot()
+		progress.Completed = true
+		publishProgress(progress)
+	}
+}
+
+// Marks the scan as Failed with the category of err and stops the collectors
+// of the scan. The rows collected so far are kept. Later failures of the same
+// scan overwrite the reason.
+func failScan(scanId int, err error, fallback ErrorCategory) {
+	category := categorize(err, fallback)
+	fmt.Printf("Failing scanId=%v. category=%v err=%v\n", scanId, category, err)
+	db.MarkScanFailed(scanId, string(category), err.Error())
+	runningScans.Lock()
+	defer runningScans.Unlock()
+	if scan, present := runningScans.scans[scanId]; present {
+		scan.cancel()
+		scan.failed = true
+		runningScans.scans[scanId] = scan
+	}
+}
+
+// Reports whether the running scan was failed by failScan.
+func hasScanFailed(scanId int) bool {
+	runningScans.Lock()
+	defer runningScans.Unlock()
+	return runningScans.scans[scanId].failed
+}
+
+// Reports whether the scan is running in this process. The status of a scan
+// which was running when the server stopped stays Running in the database,
+// those scans are not running any more.
+func isScanRunning(scanId int) bool {
+	runningScans.Lock()
+	defer runningScans.Unlock()
+	_, present := runningScans.scans[scanId]
+	return present
+}
+
+// Returns the current progress of the scan and whether it is still running.
+func GetProgress(scanId int) (Progress, bool) {
+	runningScans.Lock()
+	defer runningScans.Unlock()
+	scan, present := runningScans.scans[scanId]
+	if !present {
+		return Progress{ScanId: scanId, Completed: true}, false
+	}
+	return scan.progress.snapshot(), true
+}
+
+// Cancels all the running scans and marks them as Cancelled.
+// Returns the ids of the scans which were cancelled.
+func CancelAllScans() []int {
+	runningScans.Lock()
+	defer runningScans.Unlock()
+	scanIds := make([]int, 0, len(runningScans.scans))
+	for scanId, scan := range runningScans.scans {
+		// Already cancelled or failed, and waiting for the sink to finish.
+		if scan.ctx.Err() != nil {
+			continue
+		}
+		scan.cancel()
+		db.MarkScanCancelled(scanId)
+		scanIds = append(scanIds, scanId)
+	}
+	sort.Ints(scanIds)
+	return scanIds
+}
@@ -0,0 +1,55 @@
+package collect
+
+import (
+	"sync"
+
+	"github.com/jyothri/hdd/db"
+)
+
+// Results of a search across the scan types. Each type has at most limit
+// results, the most recent first.
+type SearchResults struct {
+	Files    []db.SearchResult `json:"files"`
+	Messages []db.SearchResult `json:"messages"`
+	Photos   []db.SearchResult `json:"photos"`
+}
+
+// Searches the file names, message subjects and photo filenames for query.
+// With a refreshToken only the scans of its account are searched, otherwise
+// all the scans are. The scan types are searched in parallel.
+func Search(query string, refreshToken string, limit int) (SearchResults, error) {
+	var results SearchResults
+	account := ""
+	if refreshToken != "" {
+		var err error
+		account, err = accountEmail(refreshToken)
+		if err != nil {
+			return results, asScanError(err, ErrorCategoryAuth)
+		}
+	}
+	var wg sync.WaitGroup
+	// The database helpers panic on errors. Those are raised again in the
+	// goroutine of the caller, where the server recovers from them.
+	var mu sync.Mutex
+	var failure interface{}
+	searchType := func(search func()) {
+		defer wg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				mu.Lock()
+				failure = r
+				mu.Unlock()
+			}
+		}()
+		search()
+	}
+	wg.Add(3)
+	go searchType(func() { results.Files = db.SearchScanDataFromDb(query, account, limit) })
+	go searchType(func() { results.Messages = db.SearchMessageMetadataFromDb(query, account, limit) })
+	go searchType(func() { results.Photos = db.SearchPhotosMediaItemFromDb(query, account, limit) })
+	wg.Wait()
+	if failure != nil {
+		panic(failure)
+	}
+	return results, nil
+}
@@ -0,0 +1,61 @@
+package collect
+
+import (
+	"github.com/jyothri/hdd/constants"
+)
+
+// Settings in effect for the scans, after the defaults and limits are
+// applied to the flags.
+type Settings struct {
+	MaxConcurrentRequests  int64                `json:"max_concurrent_requests"`
+	RateLimits             map[string]RateLimit `json:"rate_limits"`
+	DriveListRetries       int                  `json:"drive_list_retries"`
+	PhotosListRetries      int                  `json:"photos_list_retries"`
+	PhotosContentRetries   int                  `json:"photos_content_retries"`
+	InsertRetries          int                  `json:"insert_retries"`
+	MaxDroppedRows         int                  `json:"max_dropped_rows"`
+	PhotosWriteBatchSize   int                  `json:"photos_write_batch_size"`
+	PhotosWriteConcurrency int                  `json:"photos_write_concurrency"`
+	ExportBatchSize        int                  `json:"export_batch_size"`
+	ProgressInterval       string               `json:"progress_interval"`
+	ChannelBlockThreshold  string               `json:"channel_block_threshold"`
+	RerunConcurrency       int                  `json:"rerun_concurrency"`
+	StorageMaxHashSize     int64                `json:"storage_max_hash_size"`
+	RetainScans            map[string]int       `json:"retain_scans"`
+	UserAgent              string               `json:"user_agent"`
+}
+
+// Requests per second allowed to an API, with bursts of up to Burst requests.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+func GetSettings() Settings {
+	retainScans := make(map[string]int)
+	for scanType, keep := range scanRetention {
+		retainScans[scanType] = keep
+	}
+	return Settings{
+		MaxConcurrentRequests: constants.MaxConcurrentRequests,
+		RateLimits: map[string]RateLimit{
+			"photos": {RequestsPerSecond: float64(throttler.Limit()), Burst: throttler.Burst()},
+			// Each gmail scan has its own limiter.
+			"gmail": {RequestsPerSecond: gmailRateLimit, Burst: gmailBurst},
+		},
+		DriveListRetries:       constants.DriveListRetries,
+		PhotosListRetries:      constants.PhotosListRetries,
+		PhotosContentRetries:   constants.PhotosContentRetries,
+		InsertRetries:          constants.InsertRetries,
+		MaxDroppedRows:         constants.MaxDroppedRows,
+		PhotosWriteBatchSize:   photosWriteBatchSize(),
+		PhotosWriteConcurrency: photosWriteConcurrency(),
+		ExportBatchSize:        exportBatchSize,
+		ProgressInterval:       progressInterval().String(),
+		ChannelBlockThreshold:  constants.ChannelBlockThreshold.String(),
+		RerunConcurrency:       constants.RerunConcurrency,
+		StorageMaxHashSize:     constants.StorageMaxHashSize,
+		RetainScans:            retainScans,
+		UserAgent:              constants.UserAgent,
+	}
+}
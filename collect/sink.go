@@ -0,0 +1,497 @@
+package collect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/jyothri/hdd/constants"
+	"github.com/jyothri/hdd/db"
+	"google.golang.org/api/option"
+)
+
+// ScanSink is the destination for the results of a scan.
+// The scan record itself (id, status) is always kept in the database,
+// the sink decides where the collected rows are written to.
+type ScanSink interface {
+	WriteFileData(scanId int, fd db.FileData) error
+	WriteMessage(scanId int, md db.MessageMetadata) error
+	WritePhoto(scanId int, pmi db.PhotosMediaItem) error
+	// Invoked once all the results of the scan are written.
+	Complete(scanId int) error
+	// Invoked instead of Complete when the results could not be written.
+	Fail(scanId int, err error) error
+}
+
+// Where the results of a scan are written to, parsed from the Sink of the
+// scan request. Supported values are
+//   - "" or "db": database tables (default)
+//   - "stdout": JSON lines on standard output
+//   - "file:<path>": JSON lines written to the file at path relative to the
+//     sink_dir flag. Disabled unless the flag is set.
+//   - "gs://<bucket>/<object>": JSON lines written to a cloud storage object.
+//     The bucket has to be the one of the sink_bucket flag.
+//
+// The specs come from the API, so they can not point outside of the
+// directory or bucket which is set aside for the results.
+type sinkSpec struct {
+	kind   string
+	path   string
+	bucket string
+	object string
+}
+
+// Validates spec without creating anything, so that a scan is rejected
+// before its sink is created. See newScanSink.
+func parseSinkSpec(spec string) (sinkSpec, error) {
+	switch {
+	case spec == "" || spec == "db":
+		return sinkSpec{kind: "db"}, nil
+	case spec == "stdout":
+		return sinkSpec{kind: "stdout"}, nil
+	case strings.HasPrefix(spec, "file:"):
+		if constants.SinkDir == "" {
+			return sinkSpec{}, fmt.Errorf("file sinks are disabled. Set the sink_dir flag to enable them")
+		}
+		name := strings.TrimPrefix(spec, "file:")
+		if name == "" || filepath.IsAbs(name) {
+			return sinkSpec{}, fmt.Errorf("invalid file sink %q. Expected a path relative to the sink directory", spec)
+		}
+		dir := filepath.Clean(constants.SinkDir)
+		path := filepath.Join(dir, name)
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return sinkSpec{}, fmt.Errorf("invalid file sink %q. The path is outside of the sink directory", spec)
+		}
+		return sinkSpec{kind: "file", path: path}, nil
+	case strings.HasPrefix(spec, "gs://"):
+		bucketAndObject := strings.SplitN(strings.TrimPrefix(spec, "gs://"), "/", 2)
+		if len(bucketAndObject) != 2 || bucketAndObject[0] == "" || bucketAndObject[1] == "" {
+			return sinkSpec{}, fmt.Errorf("invalid cloud storage sink %q. Expected gs://<bucket>/<object>", spec)
+		}
+		if constants.SinkBucket == "" || bucketAndObject[0] != constants.SinkBucket {
+			return sinkSpec{}, fmt.Errorf("invalid cloud storage sink %q. Only the bucket of the sink_bucket flag can be written to", spec)
+		}
+		return sinkSpec{kind: "gs", bucket: bucketAndObject[0], object: bucketAndObject[1]}, nil
+	default:
+		return sinkSpec{}, fmt.Errorf("unsupported sink %q", spec)
+	}
+}
+
+// Creates the sink. Files are created or truncated here, so this is invoked
+// once the scan is validated and about to start.
+func newScanSink(spec sinkSpec) (ScanSink, error) {
+	switch spec.kind {
+	case "stdout":
+		return newJsonSink(nopCloser{os.Stdout}), nil
+	case "file":
+		file, err := os.Create(spec.path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create sink file: %w", err)
+		}
+		return newJsonSink(file), nil
+	case "gs":
+		client, err := storage.NewClient(context.Background(), option.WithUserAgent(constants.UserAgent))
+		if err != nil {
+			return nil, fmt.Errorf("unable to create cloud storage client: %w", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		writer := client.Bucket(spec.bucket).Object(spec.object).NewWriter(ctx)
+		writer.ContentType = "application/x-ndjson"
+		return newJsonSink(storageObjectWriter{writer, client, cancel}), nil
+	default:
+		return newDbSink(), nil
+	}
+}
+
+// Drains the collected file data into the sink.
+func saveFileData(sink ScanSink, scanId int, scanData <-chan db.FileData) {
+	failed := false
+	dropped := 0
+	for fd := range scanData {
+		if failed {
+			continue
+		}
+		failed = failOnError(sink, scanId, sink.WriteFileData(scanId, fd), &dropped)
+	}
+	completeScan(sink, scanId, failed, dropped)
+}
+
+// Drains the collected message metadata into the sink.
+func saveMessageMetadata(sink ScanSink, scanId int, messageMetaData <-chan db.MessageMetadata) {
+	failed := false
+	dropped := 0
+	for mmd := range messageMetaData {
+		if failed {
+			continue
+		}
+		failed = failOnError(sink, scanId, sink.WriteMessage(scanId, mmd), &dropped)
+	}
+	completeScan(sink, scanId, failed, dropped)
+}
+
+// Drains the collected media items into the sink.
+func savePhotosMediaItem(sink ScanSink, scanId int, photosMediaItem <-chan db.PhotosMediaItem) {
+	failed := false
+	dropped := 0
+	for pmi := range photosMediaItem {
+		if failed {
+			continue
+		}
+		failed = failOnError(sink, scanId, sink.WritePhoto(scanId, pmi), &dropped)
+	}
+	completeScan(sink, scanId, failed, dropped)
+}
+
+// Drops the row when writing to the sink errored. Once more than
+// MaxDroppedRows rows are dropped the scan is failed. The producer is still
+// drained afterwards so that it does not block on a full channel.
+func failOnError(sink ScanSink, scanId int, err error, dropped *int) bool {
+	if err == nil {
+		return false
+	}
+	*dropped += droppedRows(err)
+	fmt.Printf("Dropped row of scanId=%v. dropped=%v err=%v\n", scanId, *dropped, err)
+	if *dropped <= constants.MaxDroppedRows {
+		return false
+	}
+	fmt.Printf("Failing scanId=%v. err=%v\n", scanId, err)
+	checkError(sink.Fail(scanId, fmt.Errorf("dropped %v rows. last error: %w", *dropped, err)))
+	return true
+}
+
+// Returned by a sink when a write dropped more than a single row.
+type droppedRowsError struct {
+	rows int
+	err  error
+}
+
+func (e droppedRowsError) Error() string {
+	return fmt.Sprintf("%v rows could not be saved: %v", e.rows, e.err)
+}
+
+func (e droppedRowsError) Unwrap() error {
+	return e.err
+}
+
+// Number of rows lost due to the error returned by a write.
+func droppedRows(err error) int {
+	var dropErr droppedRowsError
+	if errors.As(err, &dropErr) {
+		return dropErr.rows
+	}
+	return 1
+}
+
+// Implemented by sinks which buffer writes. Flush is invoked before Complete
+// and returns the error of any write which failed since the last write. Wait
+// is invoked instead once the scan failed, the buffered writes are dropped
+// and only the ones in progress are waited for.
+type bufferedSink interface {
+	Flush(scanId int) error
+	Wait()
+}
+
+func completeScan(sink ScanSink, scanId int, failed bool, dropped int) {
+	defer finishScanContext(scanId)
+	buffered, isBuffered := sink.(bufferedSink)
+	if failed {
+		// The scan is only released once nothing writes its rows anymore, so
+		// that e.g. deleting it does not race with the writes.
+		if isBuffered {
+			buffered.Wait()
+		}
+		return
+	}
+	if isBuffered {
+		if failOnError(sink, scanId, buffered.Flush(scanId), &dropped) {
+			return
+		}
+	}
+	if hasScanFailed(scanId) {
+		// Failed by its collector, which recorded the reason. The output is
+		// not complete, so it is abandoned instead of completed.
+		if abortable, ok := sink.(abortableSink); ok {
+			abortable.Abort()
+		}
+		return
+	}
+	if dropped > 0 {
+		db.LogScanWarning(scanId, fmt.Sprintf("%v rows could not be saved", dropped))
+	}
+	checkError(sink.Complete(scanId))
+}
+
+// Implemented by sinks whose output can be abandoned instead of completed,
+// when the scan failed.
+type abortableSink interface {
+	Abort()
+}
+
+// dbSink writes the results to the database tables. This is the default sink.
+// Media items are buffered and inserted in batches of PhotosWriteBatchSize
+// by up to PhotosWriteConcurrency transactions at a time. The writes are
+// invoked from the single goroutine draining the scan.
+type dbSink struct {
+	photos []db.PhotosMediaItem
+	slots  chan struct{}
+	writes sync.WaitGroup
+
+	mu         sync.Mutex
+	dropped    int
+	droppedErr error
+}
+
+func newDbSink() *dbSink {
+	return &dbSink{slots: make(chan struct{}, photosWriteConcurrency())}
+}
+
+func (*dbSink) WriteFileData(scanId int, fd db.FileData) error {
+	return retryInsert(func() error {
+		return db.SaveStatToDb(scanId, fd)
+	})
+}
+
+func (*dbSink) WriteMessage(scanId int, md db.MessageMetadata) error {
+	return retryInsert(func() error {
+		return db.SaveMessageMetadataToDb(scanId, md)
+	})
+}
+
+func (s *dbSink) WritePhoto(scanId int, pmi db.PhotosMediaItem) error {
+	s.photos = append(s.photos, pmi)
+	if len(s.photos) >= photosWriteBatchSize() {
+		s.flushPhotos(scanId)
+	}
+	return s.takeDropped()
+}
+
+func (s *dbSink) Flush(scanId int) error {
+	if len(s.photos) > 0 {
+		s.flushPhotos(scanId)
+	}
+	s.writes.Wait()
+	return s.takeDropped()
+}
+
+func (s *dbSink) Wait() {
+	s.writes.Wait()
+}
+
+func photosWriteBatchSize() int {
+	// Keeps the insert below the bind parameter limit of postgres.
+	const maxBatchSize = 5000
+	batchSize := constants.PhotosWriteBatchSize
+	if batchSize < 1 {
+		return 1
+	}
+	if batchSize > maxBatchSize {
+		return maxBatchSize
+	}
+	return batchSize
+}
+
+func photosWriteConcurrency() int {
+	if constants.PhotosWriteConcurrency < 1 {
+		return 1
+	}
+	return constants.PhotosWriteConcurrency
+}
+
+// Inserts the buffered media items in the background. Blocks while
+// PhotosWriteConcurrency batches are being inserted.
+func (s *dbSink) flushPhotos(scanId int) {
+	batch := s.photos
+	s.photos = nil
+	s.slots <- struct{}{}
+	s.writes.Add(1)
+	go func() {
+		defer func() {
+			<-s.slots
+			s.writes.Done()
+		}()
+		err := savePhotosBatch(scanId, batch)
+		if err != nil {
+			s.mu.Lock()
+			s.dropped += droppedRows(err)
+			s.droppedErr = err
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// Returns the rows dropped by the batches inserted since the last call.
+func (s *dbSink) takeDropped() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropped == 0 {
+		return nil
+	}
+	err := droppedRowsError{rows: s.dropped, err: s.droppedErr}
+	s.dropped, s.droppedErr = 0, nil
+	return err
+}
+
+// Falls back to inserting one item at a time when the batch fails, so that
+// a single bad item does not drop the whole batch.
+func savePhotosBatch(scanId int, batch []db.PhotosMediaItem) error {
+	err := retryInsert(func() error {
+		return db.SavePhotosMediaItemsToDb(scanId, batch)
+	})
+	if err == nil || len(batch) == 1 {
+		return err
+	}
+	fmt.Printf("Inserting %v media items of scanId=%v one at a time. err=%v\n", len(batch), scanId, err)
+	dropped := 0
+	for _, pmi := range batch {
+		pmi := pmi
+		itemErr := retryInsert(func() error {
+			return db.SavePhotosMediaItemToDb(scanId, pmi)
+		})
+		if itemErr != nil {
+			dropped++
+			err = itemErr
+		}
+	}
+	if dropped == 0 {
+		return nil
+	}
+	return droppedRowsError{rows: dropped, err: err}
+}
+
+// Runs the insert again with a backoff while it fails with a transient
+// database error, at most InsertRetries times. Other errors are returned
+// right away.
+func retryInsert(insert func() error) error {
+	err := insert()
+	for attempt := 0; err != nil && attempt < constants.InsertRetries && db.IsTransientError(err); attempt++ {
+		fmt.Printf("Retrying insert. attempt=%v err=%v\n", attempt+1, err)
+		time.Sleep(retryBackoff(attempt))
+		err = insert()
+	}
+	return err
+}
+
+func (*dbSink) Complete(scanId int) error {
+	db.LogCompleteScan(scanId)
+	compactScans(scanId)
+	return nil
+}
+
+func (*dbSink) Fail(scanId int, err error) error {
+	return markSinkFailed(scanId, err)
+}
+
+// jsonSink writes every result as a JSON object on its own line.
+type jsonSink struct {
+	mu      sync.Mutex
+	writer  io.WriteCloser
+	encoder *json.Encoder
+}
+
+type jsonSinkRecord struct {
+	ScanId int         `json:"scan_id"`
+	Type   string      `json:"type"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+func newJsonSink(writer io.WriteCloser) *jsonSink {
+	return &jsonSink{
+		writer:  writer,
+		encoder: json.NewEncoder(writer),
+	}
+}
+
+func (s *jsonSink) write(record jsonSinkRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.encoder.Encode(record)
+}
+
+func (s *jsonSink) WriteFileData(scanId int, fd db.FileData) error {
+	return s.write(jsonSinkRecord{ScanId: scanId, Type: "file_data", Data: fd})
+}
+
+func (s *jsonSink) WriteMessage(scanId int, md db.MessageMetadata) error {
+	return s.write(jsonSinkRecord{ScanId: scanId, Type: "message_metadata", Data: md})
+}
+
+func (s *jsonSink) WritePhoto(scanId int, pmi db.PhotosMediaItem) error {
+	return s.write(jsonSinkRecord{ScanId: scanId, Type: "photos_media_item", Data: pmi})
+}
+
+func (s *jsonSink) Complete(scanId int) error {
+	err := s.write(jsonSinkRecord{ScanId: scanId, Type: "complete"})
+	if err != nil {
+		return s.Fail(scanId, err)
+	}
+	// The writer is closed, failing the scan must not close it again.
+	err = s.writer.Close()
+	if err != nil {
+		return markSinkFailed(scanId, err)
+	}
+	db.LogCompleteScan(scanId)
+	return nil
+}
+
+func (s *jsonSink) Fail(scanId int, err error) error {
+	s.Abort()
+	return markSinkFailed(scanId, err)
+}
+
+// Closes the writer without completing the output. An upload is cancelled,
+// so that no truncated object is left behind which looks complete.
+func (s *jsonSink) Abort() {
+	if aborter, ok := s.writer.(writeAborter); ok {
+		aborter.Abort()
+		return
+	}
+	s.writer.Close()
+}
+
+// Implemented by writers which can stop without finalizing their output.
+type writeAborter interface {
+	Abort()
+}
+
+func markSinkFailed(scanId int, err error) error {
+	db.MarkScanFailed(scanId, string(categorize(err, ErrorCategoryUnknown)), err.Error())
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Finalizes the upload of the object before releasing the client. Abort
+// cancels the upload instead, the object is then not created.
+type storageObjectWriter struct {
+	*storage.Writer
+	client *storage.Client
+	cancel context.CancelFunc
+}
+
+func (w storageObjectWriter) Close() error {
+	defer w.client.Close()
+	defer w.cancel()
+	return w.Writer.Close()
+}
+
+func (w storageObjectWriter) Abort() {
+	w.cancel()
+	// Returns the error of the cancelled upload.
+	w.Writer.Close()
+	w.client.Close()
+}
@@ -2,6 +2,8 @@ package constants
 
 import (
 	"flag"
+	"testing"
+	"time"
 )
 
 var (
@@ -9,6 +11,51 @@ var (
 	OauthClientSecret string
 	RefreshToken      string
 	StartWebServer    bool
+	// Maximum number of network calls to Google APIs in flight across all scans.
+	MaxConcurrentRequests int64
+	PhotosListRetries     int
+	PhotosContentRetries  int
+	DriveListRetries      int
+	// Retries of an insert which failed with a transient database error.
+	InsertRetries int
+	// Rows of a scan which may be dropped after failing to be written
+	// before the whole scan is marked as failed.
+	MaxDroppedRows int
+	// Media items of a photos scan inserted with a single transaction, and
+	// the number of such transactions of a scan running at the same time.
+	PhotosWriteBatchSize   int
+	PhotosWriteConcurrency int
+	// Interval at which the progress of running scans is logged and published.
+	ProgressInterval time.Duration
+	// Sent with all the requests to Google APIs, to tell them apart in the
+	// Google Cloud logs and quota dashboards.
+	UserAgent string
+	// Origin of the frontend which is allowed to call the API. With CorsMode
+	// dev, localhost on any port is allowed as well.
+	FrontendUrl string
+	CorsMode    string
+	// A send to the sink of a scan blocked for longer than this is counted and
+	// logged as the database holding up the scan.
+	ChannelBlockThreshold time.Duration
+	// Number of scans of each source to keep the rows of, per scan type, e.g.
+	// photos=2,gmail=3. Empty keeps all the scans.
+	RetainScans string
+	// Time allowed for exchanging the authorization code of a linked account
+	// for the tokens. Kept below the write timeout of the server, so that the
+	// 504 reaches the browser.
+	OauthTokenTimeout time.Duration
+	// Directory and bucket which the file: and gs:// sinks of the scans can
+	// write to. Those sinks are disabled when not set.
+	SinkDir    string
+	SinkBucket string
+	// Scans started at the same time by a batch rerun.
+	RerunConcurrency int
+	// Largest storage object downloaded to compute its MD5 hash, when a scan
+	// does not set its own limit. 0 downloads every object.
+	StorageMaxHashSize int64
+	// Serves the effective settings of the server at /api/config. The API has
+	// no authentication, so it is off unless a deployment is being debugged.
+	EnableConfigEndpoint bool
 )
 
 func init() {
@@ -16,5 +63,29 @@ func init() {
 	flag.StringVar(&OauthClientSecret, "oauth_client_secret", "dummy", "oauth client secret")
 	flag.StringVar(&RefreshToken, "refresh_token", "dummy", "refresh token for the user")
 	flag.BoolVar(&StartWebServer, "start_web_server", false, "Set to true to start a web server.")
-	flag.Parse()
+	flag.Int64Var(&MaxConcurrentRequests, "max_concurrent_requests", 50, "maximum number of in-flight API requests across all scans")
+	flag.IntVar(&PhotosListRetries, "photos_list_retries", 25, "number of retries when listing photos media items fails")
+	flag.IntVar(&PhotosContentRetries, "photos_content_retries", 5, "number of retries when fetching photos content fails")
+	flag.IntVar(&DriveListRetries, "drive_list_retries", 5, "number of retries when listing drive files fails due to rate limits or server errors")
+	flag.IntVar(&InsertRetries, "insert_retries", 3, "number of retries when inserting a row fails with a transient database error")
+	flag.IntVar(&MaxDroppedRows, "max_dropped_rows", 100, "number of rows of a scan which can be dropped before the scan is failed")
+	flag.IntVar(&PhotosWriteBatchSize, "photos_write_batch_size", 500, "number of photos media items inserted per transaction. At most 5000")
+	flag.IntVar(&PhotosWriteConcurrency, "photos_write_concurrency", 2, "number of concurrent photos insert transactions per scan")
+	flag.DurationVar(&ProgressInterval, "progress_interval", 5*time.Second, "interval at which the progress of running scans is reported")
+	flag.StringVar(&UserAgent, "user_agent", "bhandaar", "User-Agent of the requests to Google APIs")
+	flag.StringVar(&FrontendUrl, "frontend_url", "http://localhost:8080", "origin of the frontend allowed to call the API")
+	flag.StringVar(&CorsMode, "cors_mode", "strict", "strict allows only frontend_url. dev also allows localhost on any port")
+	flag.DurationVar(&ChannelBlockThreshold, "channel_block_threshold", time.Second, "time a scan waits on the database before it is logged as blocked")
+	flag.StringVar(&RetainScans, "retain_scans", "", "scans of a source to keep the rows of, per scan type. e.g. photos=2,gmail=3")
+	flag.DurationVar(&OauthTokenTimeout, "oauth_token_timeout", 8*time.Second, "timeout of the token exchange when linking an account")
+	flag.StringVar(&SinkDir, "sink_dir", "", "directory the file: sinks of the scans are written to. file: sinks are disabled when empty")
+	flag.StringVar(&SinkBucket, "sink_bucket", "", "bucket the gs:// sinks of the scans are written to. gs:// sinks are disabled when empty")
+	flag.IntVar(&RerunConcurrency, "rerun_concurrency", 2, "number of scans started at the same time when rerunning a batch of scans")
+	flag.Int64Var(&StorageMaxHashSize, "storage_max_hash_size", 1<<30, "largest storage object in bytes downloaded to hash it, unless a scan sets its own limit. 0 downloads every object")
+	flag.BoolVar(&EnableConfigEndpoint, "enable_config_endpoint", false, "serve the effective settings of the server at /api/config")
+	// The flags of go test are only known once the tests start. The tests run
+	// with the defaults.
+	if !testing.Testing() {
+		flag.Parse()
+	}
 }
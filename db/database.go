@@ -1,13 +1,16 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"path/filepath"
 	"strings"
+	"testing"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 const (
@@ -18,137 +21,345 @@ const (
 	dbname   = "postgres"
 )
 
+// Number of rows returned per page by the listing queries.
+const PageSize = 10
+
 var db *sqlx.DB
 
 func init() {
+	// The tests which need a database connect in TestMain, so that the other
+	// tests run without one.
+	if testing.Testing() {
+		return
+	}
+	checkError(setup())
+}
+
+// Connects to the database and applies the migrations.
+func setup() error {
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
 		"password=%s dbname=%s sslmode=disable",
 		host, port, user, password, dbname)
 	var err error
 	db, err = sqlx.Open("postgres", psqlInfo)
-	checkError(err)
+	if err != nil {
+		return err
+	}
 	err = db.Ping()
-	checkError(err)
+	if err != nil {
+		return err
+	}
 	fmt.Println("Successfully connected to DB!")
 	migrateDB()
+	return nil
+}
+
+// Where the database is. The password is left out.
+type DatabaseInfo struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	User string `json:"user"`
+	Name string `json:"name"`
+}
+
+func GetDatabaseInfo() DatabaseInfo {
+	return DatabaseInfo{Host: host, Port: port, User: user, Name: dbname}
+}
+
+// Reports whether the database is currently reachable. The server only starts
+// once init connected and applied the migrations, so the setup is complete.
+func Ready() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return db.PingContext(ctx)
 }
 
 func LogStartScan(scanType string) int {
 	insert_row := `insert into scans 
-									(scan_type, created_on, scan_start_time) 
+									(scan_type, created_on, scan_start_time, status) 
 								values 
-									($1, current_timestamp, current_timestamp) RETURNING id`
+									($1, current_timestamp, current_timestamp, 'Running') RETURNING id`
 	lastInsertId := 0
 	err := db.QueryRow(insert_row, scanType).Scan(&lastInsertId)
 	checkError(err)
 	return lastInsertId
 }
 
-func SaveScanMetadata(searchPath string, searchFilter string, scanId int) {
+// account is the email address of the account of the scans of Google APIs.
+// It is empty for the scans which do not belong to an account, or whose
+// account is not known, and stored as NULL.
+func SaveScanMetadata(searchPath string, searchFilter string, account string, scanId int) {
 	insert_row := `insert into scanmetadata 
-			(name, search_path, search_filter, scan_id) 
+			(name, search_path, search_filter, account_key, scan_id) 
 		values 
-			($1, $2, $3, $4) RETURNING id`
+			($1, $2, $3, $4, $5) RETURNING id`
 	var err error
-	_, err = db.Exec(insert_row, nil, searchPath, searchFilter, scanId)
+	var accountKey interface{}
+	if account != "" {
+		accountKey = account
+	}
+	_, err = db.Exec(insert_row, nil, searchPath, searchFilter, accountKey, scanId)
 	checkError(err)
 }
 
-func SaveMessageMetadataToDb(scanId int, messageMetaData <-chan MessageMetadata) {
-	for {
-		mmd, more := <-messageMetaData
-		if !more {
-			logCompleteScan(scanId)
-			break
-		}
-		insert_row := `insert into messagemetadata 
-			(message_id, thread_id, date, mail_from, mail_to, subject, size_estimate, labels, scan_id) 
-		values 
-			($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
-		var err error
-		_, err = db.Exec(insert_row, mmd.MessageId, mmd.ThreadId, mmd.Date, substr(mmd.From, 500),
-			substr(mmd.To, 500), substr(mmd.Subject, 2000), mmd.SizeEstimate,
-			substr(strings.Join(mmd.LabelIds, ","), 500), scanId)
-		checkError(err, fmt.Sprintf("While inserting to messagemetadata messageId:%v", mmd.MessageId))
+// Records the directories of a local scan. Unlike search_path they are read
+// back as they were, whatever characters the paths contain.
+func SaveScanRoots(scanId int, roots []string) {
+	update_row := `update scanmetadata set roots = $1 where scan_id = $2`
+	_, err := db.Exec(update_row, pq.StringArray(roots), scanId)
+	checkError(err)
+}
+
+// Records how far a scan progressed so that it can be continued later.
+func SaveScanCheckpoint(scanId int, pageToken string, itemsProcessed int) {
+	update_row := `update scanmetadata 
+								 set page_token = $1, items_processed = $2 
+								 where scan_id = $3`
+	_, err := db.Exec(update_row, pageToken, itemsProcessed, scanId)
+	checkError(err)
+}
+
+// Returns the parameters and the last checkpoint of a scan.
+func GetScanCheckpoint(scanId int) (ScanCheckpoint, error) {
+	read_row := `select scan_type, status, search_path, search_filter, roots, account_key, page_token, items_processed 
+		from scans S JOIN scanmetadata SM ON S.id = SM.scan_id 
+		where S.id = $1`
+	checkpoint := ScanCheckpoint{}
+	err := db.Get(&checkpoint, read_row, scanId)
+	if err == sql.ErrNoRows {
+		return checkpoint, fmt.Errorf("no scan found with scanId=%v", scanId)
 	}
+	return checkpoint, err
 }
 
-func SavePhotosMediaItemToDb(scanId int, photosMediaItem <-chan PhotosMediaItem) {
-	for {
-		pmi, more := <-photosMediaItem
-		if !more {
-			logCompleteScan(scanId)
-			break
-		}
-		insert_row := `insert into photosmediaitem 
+// Returns the most recent scan of the given type and search path which
+// completed, or 0 when there is none.
+func GetLatestCompletedScanId(scanType string, searchPath string) int {
+	read_row := `select S.id from scans S JOIN scanmetadata SM ON S.id = SM.scan_id 
+		where scan_type = $1 and search_path = $2 
+		  and COALESCE(status, 'Completed') in ('Completed', 'CompletedWithWarning') 
+		order by S.id desc limit 1`
+	var scanId int
+	err := db.Get(&scanId, read_row, scanType, searchPath)
+	if err == sql.ErrNoRows {
+		return 0
+	}
+	checkError(err)
+	return scanId
+}
+
+// Returns the hashed files of a scan keyed by their path.
+func GetHashedFilesFromDb(scanId int) map[string]HashedFile {
+	read_row := `select path, size, file_mod_time, md5hash from scandata 
+		where scan_id = $1 and is_dir = false and md5hash <> ''`
+	hashedFiles := []HashedFile{}
+	err := db.Select(&hashedFiles, read_row, scanId)
+	checkError(err)
+	filesByPath := make(map[string]HashedFile, len(hashedFiles))
+	for _, hashedFile := range hashedFiles {
+		filesByPath[hashedFile.Path] = hashedFile
+	}
+	return filesByPath
+}
+
+// Marks a finished scan as Running again so that it can be continued.
+func ReopenScan(scanId int) {
+	update_row := `update scans 
+								 set scan_end_time = NULL, status = 'Running', status_msg = NULL, 
+								 error_category = NULL 
+								 where id = $1`
+	_, err := db.Exec(update_row, scanId)
+	checkError(err)
+}
+
+// Attaches a warning to a scan. A scan with a warning is marked as
+// CompletedWithWarning instead of Completed once it finishes.
+func LogScanWarning(scanId int, warning string) {
+	update_row := `update scans 
+								 set status_msg = $1 
+								 where id = $2`
+	_, err := db.Exec(update_row, warning, scanId)
+	checkError(err)
+}
+
+// Records the warning along with the category of the error which caused it.
+// The scan keeps running and completes with a warning.
+func LogScanWarningWithCategory(scanId int, category string, warning string) {
+	update_row := `update scans 
+								 set status_msg = $1, error_category = $2 
+								 where id = $3`
+	_, err := db.Exec(update_row, warning, category, scanId)
+	checkError(err)
+}
+
+func SaveMessageMetadataToDb(scanId int, mmd MessageMetadata) error {
+	// Resumed scans can fetch a message again. Those are skipped.
+	insert_row := `insert into messagemetadata 
+			(message_id, thread_id, date, mail_from, mail_to, subject, size_estimate, labels, label_names, scan_id, internal_date) 
+		select $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11 
+		where not exists (select 1 from messagemetadata where scan_id = $10 and message_id = $1)`
+	var labelNames interface{}
+	if mmd.LabelNames != nil {
+		labelNames = substr(strings.Join(mmd.LabelNames, ","), 1000)
+	}
+	var internalDate interface{}
+	if !mmd.InternalDate.IsZero() {
+		internalDate = mmd.InternalDate
+	}
+	_, err := db.Exec(insert_row, mmd.MessageId, mmd.ThreadId, mmd.Date, substr(mmd.From, 500),
+		substr(mmd.To, 500), substr(mmd.Subject, 2000), mmd.SizeEstimate,
+		substr(strings.Join(mmd.LabelIds, ","), 500), labelNames, scanId, internalDate)
+	if err != nil {
+		return fmt.Errorf("while inserting to messagemetadata messageId:%v: %w", mmd.MessageId, err)
+	}
+	return nil
+}
+
+// The media item and its photo or video metadata are inserted in a single
+// transaction so that a failed insert can be retried without duplicates.
+func SavePhotosMediaItemToDb(scanId int, pmi PhotosMediaItem) error {
+	return SavePhotosMediaItemsToDb(scanId, []PhotosMediaItem{pmi})
+}
+
+// Inserts the media items along with their photo or video metadata in a
+// single transaction, with one statement per table. The number of items is
+// limited by the 65535 bind parameters of a statement.
+func SavePhotosMediaItemsToDb(scanId int, pmis []PhotosMediaItem) error {
+	if len(pmis) == 0 {
+		return nil
+	}
+	firstMediaItemId := pmis[0].MediaItemId
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("while inserting to photosmediaitem mediaItemId:%v: %w", firstMediaItemId, err)
+	}
+	defer tx.Rollback()
+	insert_row := `insert into photosmediaitem 
 			(media_item_id, product_url, mime_type, filename, size, scan_id, file_mod_time, 
-				contributor_display_name, md5hash) 
-		values 
-			($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
-		var err error
-		lastInsertId := 0
-		err = db.QueryRow(insert_row, pmi.MediaItemId, pmi.ProductUrl, pmi.MimeType, pmi.Filename,
-			pmi.Size, scanId, pmi.FileModTime, pmi.ContributorDisplayName, pmi.Md5hash).Scan(&lastInsertId)
-		checkError(err, fmt.Sprintf("While inserting to photosmediaitem mediaItemId:%v", pmi.MediaItemId))
-
-		switch pmi.MimeType[:5] {
-		case "image":
+				contributor_display_name, contributor_profile_url, md5hash, latitude, longitude) 
+		values ` + valuesPlaceholders(len(pmis), 12) + ` RETURNING id, media_item_id`
+	args := make([]interface{}, 0, len(pmis)*12)
+	for _, pmi := range pmis {
+		args = append(args, pmi.MediaItemId, pmi.ProductUrl, pmi.MimeType, pmi.Filename,
+			pmi.Size, scanId, pmi.FileModTime.UTC(), pmi.ContributorDisplayName, pmi.ContributorProfileUrl,
+			pmi.Md5hash, pmi.Latitude, pmi.Longitude)
+	}
+	rows, err := tx.Query(insert_row, args...)
+	if err != nil {
+		return fmt.Errorf("while inserting to photosmediaitem mediaItemId:%v: %w", firstMediaItemId, err)
+	}
+	// The order of the returned rows is not guaranteed, the ids are matched
+	// to the items using the media item id instead.
+	insertedIds := make(map[string][]int, len(pmis))
+	for rows.Next() {
+		var id int
+		var mediaItemId string
+		err = rows.Scan(&id, &mediaItemId)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("while inserting to photosmediaitem mediaItemId:%v: %w", firstMediaItemId, err)
+		}
+		insertedIds[mediaItemId] = append(insertedIds[mediaItemId], id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("while inserting to photosmediaitem mediaItemId:%v: %w", firstMediaItemId, err)
+	}
+
+	photoArgs := []interface{}{}
+	videoArgs := []interface{}{}
+	for _, pmi := range pmis {
+		ids := insertedIds[pmi.MediaItemId]
+		lastInsertId := ids[0]
+		insertedIds[pmi.MediaItemId] = ids[1:]
+		switch {
+		case strings.HasPrefix(pmi.MimeType, "image/"):
 			//e.g. image/jpeg image/png image/gif
-			insert_photo_row := `insert into photometadata 
-			(photos_media_item_id, camera_make, camera_model, focal_length, f_number, iso, exposure_time) 
-		values 
-			($1, $2, $3, $4, $5, $6, $7) RETURNING id`
-			_, err = db.Exec(insert_photo_row, lastInsertId, pmi.CameraMake, pmi.CameraModel, pmi.FocalLength,
+			photoArgs = append(photoArgs, lastInsertId, pmi.CameraMake, pmi.CameraModel, pmi.FocalLength,
 				pmi.FNumber, pmi.Iso, pmi.ExposureTime)
-			checkError(err, fmt.Sprintf("While inserting to photometadata mediaItemId:%v", pmi.MediaItemId))
-		case "video":
+		case strings.HasPrefix(pmi.MimeType, "video/"):
 			//e.g. video/mp4
-			insert_video_row := `insert into videometadata 
-			(photos_media_item_id, camera_make, camera_model, fps) 
-		values 
-			($1, $2, $3, $4) RETURNING id`
-			_, err = db.Exec(insert_video_row, lastInsertId, pmi.CameraMake, pmi.CameraModel, pmi.Fps)
-			checkError(err, fmt.Sprintf("While inserting to videometadata mediaItemId:%v", pmi.MediaItemId))
+			videoArgs = append(videoArgs, lastInsertId, pmi.CameraMake, pmi.CameraModel, pmi.Fps)
 		default:
 			fmt.Println("Unsupported mime type.")
 		}
 	}
+	if len(photoArgs) > 0 {
+		insert_photo_row := `insert into photometadata 
+			(photos_media_item_id, camera_make, camera_model, focal_length, f_number, iso, exposure_time) 
+		values ` + valuesPlaceholders(len(photoArgs)/7, 7)
+		_, err = tx.Exec(insert_photo_row, photoArgs...)
+		if err != nil {
+			return fmt.Errorf("while inserting to photometadata mediaItemId:%v: %w", firstMediaItemId, err)
+		}
+	}
+	if len(videoArgs) > 0 {
+		insert_video_row := `insert into videometadata 
+			(photos_media_item_id, camera_make, camera_model, fps) 
+		values ` + valuesPlaceholders(len(videoArgs)/4, 4)
+		_, err = tx.Exec(insert_video_row, videoArgs...)
+		if err != nil {
+			return fmt.Errorf("while inserting to videometadata mediaItemId:%v: %w", firstMediaItemId, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("while inserting to photosmediaitem mediaItemId:%v: %w", firstMediaItemId, err)
+	}
+	return nil
 }
 
-func SaveStatToDb(scanId int, scanData <-chan FileData) {
-	for {
-		fd, more := <-scanData
-		if !more {
-			logCompleteScan(scanId)
-			break
+// Returns the placeholders for a multi row insert, e.g. ($1, $2), ($3, $4)
+func valuesPlaceholders(rows int, columns int) string {
+	var sb strings.Builder
+	for row := 0; row < rows; row++ {
+		if row > 0 {
+			sb.WriteString(", ")
 		}
-		insert_row := `insert into scandata 
-			(name, path, size, file_mod_time, md5hash, scan_id, is_dir, file_count) 
-		values 
-			($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
-		var err error
-		if fd.IsDir {
-			_, err = db.Exec(insert_row, fd.FileName, fd.FilePath, fd.Size, fd.ModTime, fd.Md5Hash, scanId, fd.IsDir, fd.FileCount)
-		} else {
-			_, err = db.Exec(insert_row, fd.FileName, fd.FilePath, fd.Size, fd.ModTime, fd.Md5Hash, scanId, fd.IsDir, nil)
+		sb.WriteString("(")
+		for column := 1; column <= columns; column++ {
+			if column > 1 {
+				sb.WriteString(", ")
+			}
+			fmt.Fprintf(&sb, "$%d", row*columns+column)
 		}
-		checkError(err)
+		sb.WriteString(")")
+	}
+	return sb.String()
+}
+
+func SaveStatToDb(scanId int, fd FileData) error {
+	insert_row := `insert into scandata 
+			(name, path, size, file_mod_time, md5hash, scan_id, is_dir, file_count, hash_skipped, root) 
+		values 
+			($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`
+	var err error
+	var root interface{}
+	if fd.Root != "" {
+		root = fd.Root
 	}
+	if fd.IsDir {
+		_, err = db.Exec(insert_row, fd.FileName, fd.FilePath, fd.Size, fd.ModTime.UTC(), fd.Md5Hash, scanId, fd.IsDir, fd.FileCount, fd.HashSkipped, root)
+	} else {
+		_, err = db.Exec(insert_row, fd.FileName, fd.FilePath, fd.Size, fd.ModTime.UTC(), fd.Md5Hash, scanId, fd.IsDir, nil, fd.HashSkipped, root)
+	}
+	if err != nil {
+		return fmt.Errorf("while inserting to scandata path:%v: %w", fd.FilePath, err)
+	}
+	return nil
 }
 
 func GetScansFromDb(pageNo int) ([]Scan, int) {
-	limit := 10
+	limit := PageSize
 	offset := limit * (pageNo - 1)
 	count_rows := `select count(*) from scans`
 	read_row :=
-		`select S.id, scan_type, 
-		 created_on AT TIME ZONE 'UTC' AT TIME ZONE 'America/Los_Angeles' as created_on, 
-		 scan_start_time AT TIME ZONE 'UTC' AT TIME ZONE 'America/Los_Angeles' as scan_start_time, 
-		 scan_end_time, CONCAT(search_path, search_filter) as metadata,
+		`select S.id, scan_type, created_on, scan_start_time,
+		 scan_end_time, CONCAT(search_path, search_filter) as metadata, status, status_msg, error_category, compacted_on,
 		 date_trunc('millisecond', COALESCE(scan_end_time,current_timestamp)-scan_start_time) as duration
 	   from scans S LEFT JOIN scanmetadata SM
 		 ON S.id = SM.scan_id
-		 order by id limit $1 OFFSET $2
+		 order by id desc limit $1 OFFSET $2
 		`
 	scans := []Scan{}
 	var count int
@@ -159,12 +370,46 @@ func GetScansFromDb(pageNo int) ([]Scan, int) {
 	return scans, count
 }
 
+// Lists the scans of a source, most recent first. searchPath matches the
+// directory of local scans and the bucket of storage scans, searchFilter
+// matches the query of drive and gmail scans. Empty values match everything.
+// A local scan of several directories matches each of its roots.
+func GetScansBySourceFromDb(searchPath string, searchFilter string, pageNo int) ([]Scan, int) {
+	limit := PageSize
+	offset := limit * (pageNo - 1)
+	if searchPath != "" {
+		// The directories are stored cleaned, see collect.LocalScan.
+		searchPath = filepath.Clean(searchPath)
+	}
+	source_filter := `($1 = '' or search_path in ($1, 'dir=' || $1, 'bucket=' || $1) or $1 = ANY(SM.roots))
+		 and ($2 = '' or search_filter = $2)`
+	count_rows := `select count(*) from scans S JOIN scanmetadata SM
+		 ON S.id = SM.scan_id
+		 where ` + source_filter
+	read_row :=
+		`select S.id, scan_type, created_on, scan_start_time,
+		 scan_end_time, CONCAT(search_path, search_filter) as metadata, status, status_msg, error_category, compacted_on,
+		 date_trunc('millisecond', COALESCE(scan_end_time,current_timestamp)-scan_start_time) as duration
+	   from scans S JOIN scanmetadata SM
+		 ON S.id = SM.scan_id
+		 where ` + source_filter + `
+		 order by id desc limit $3 OFFSET $4
+		`
+	scans := []Scan{}
+	var count int
+	err := db.Select(&scans, read_row, searchPath, searchFilter, limit, offset)
+	checkError(err)
+	err = db.Get(&count, count_rows, searchPath, searchFilter)
+	checkError(err)
+	return scans, count
+}
+
 func GetMessageMetadataFromDb(scanId int, pageNo int) ([]MessageMetadataRead, int) {
-	limit := 10
+	limit := PageSize
 	offset := limit * (pageNo - 1)
 	count_rows := `select count(*) from messagemetadata where scan_id = $1`
 	read_row := `select id, message_id, thread_id, date, mail_from, mail_to,
-							 subject, size_estimate, labels, scan_id
+							 subject, size_estimate, labels, label_names, scan_id
 	             from messagemetadata 
 							 where scan_id = $1 order by id limit $2 offset $3`
 	messageMetadata := []MessageMetadataRead{}
@@ -176,12 +421,34 @@ func GetMessageMetadataFromDb(scanId int, pageNo int) ([]MessageMetadataRead, in
 	return messageMetadata, count
 }
 
+// Lists the threads of the scan. The latest subject of a thread is the one of
+// the message which Gmail received last.
+func GetMessageThreadsFromDb(scanId int, pageNo int) ([]MessageThread, int) {
+	limit := PageSize
+	offset := limit * (pageNo - 1)
+	count_rows := `select count(distinct thread_id) from messagemetadata where scan_id = $1`
+	read_row := `select thread_id, count(*) as message_count,
+								COALESCE(sum(size_estimate), 0) as total_size,
+								(array_agg(subject order by internal_date desc nulls last, id desc))[1] as latest_subject
+							 from messagemetadata
+							 where scan_id = $1
+							 group by thread_id order by max(id) limit $2 offset $3`
+	messageThreads := []MessageThread{}
+	var count int
+	err := db.Get(&count, count_rows, scanId)
+	checkError(err)
+	err = db.Select(&messageThreads, read_row, scanId, limit, offset)
+	checkError(err)
+	return messageThreads, count
+}
+
 func GetPhotosMediaItemFromDb(scanId int, pageNo int) ([]PhotosMediaItemRead, int) {
-	limit := 10
+	limit := PageSize
 	offset := limit * (pageNo - 1)
 	count_rows := `select count(*) from photosmediaitem where scan_id = $1`
 	read_row := `select id, media_item_id, product_url, mime_type, filename,
-								size, file_mod_time, md5hash, scan_id, contributor_display_name 
+								size, file_mod_time, md5hash, scan_id, contributor_display_name,
+								contributor_profile_url, latitude, longitude 
 								from photosmediaitem 
 							 where scan_id = $1 order by id limit $2 offset $3`
 	photosMediaItemRead := []PhotosMediaItemRead{}
@@ -193,8 +460,29 @@ func GetPhotosMediaItemFromDb(scanId int, pageNo int) ([]PhotosMediaItemRead, in
 	return photosMediaItemRead, count
 }
 
+// Returns the Google Photos id of a media item of the scan.
+func GetMediaItemIdFromDb(scanId int, photosMediaItemId int) (string, error) {
+	read_row := `select media_item_id from photosmediaitem where scan_id = $1 and id = $2`
+	var mediaItemId string
+	err := db.Get(&mediaItemId, read_row, scanId, photosMediaItemId)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("no media item %v found in scanId=%v", photosMediaItemId, scanId)
+	}
+	return mediaItemId, err
+}
+
+func GetScanTypeFromDb(scanId int) (string, error) {
+	read_row := `select scan_type from scans where id = $1`
+	var scanType string
+	err := db.Get(&scanType, read_row, scanId)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("no scan found with scanId=%v", scanId)
+	}
+	return scanType, err
+}
+
 func GetScanDataFromDb(scanId int, pageNo int) ([]ScanData, int) {
-	limit := 10
+	limit := PageSize
 	offset := limit * (pageNo - 1)
 	count_rows := `select count(*) from scandata where scan_id = $1`
 	read_row := `select * from scandata where scan_id = $1 order by id limit $2 offset $3`
@@ -207,58 +495,259 @@ func GetScanDataFromDb(scanId int, pageNo int) ([]ScanData, int) {
 	return scandata, count
 }
 
+// Aggregates the data tracked across all the scans.
+func GetGlobalStatsFromDb() GlobalStats {
+	files_query := `select count(*) as count, COALESCE(sum(size), 0) as size 
+		from scandata where COALESCE(is_dir, false) = false`
+	messages_query := `select count(*) as count, COALESCE(sum(size_estimate), 0) as size 
+		from messagemetadata`
+	photos_query := `select count(*) as count, COALESCE(sum(size) filter (where size > 0), 0) as size 
+		from photosmediaitem`
+	scans_by_type_query := `select scan_type, count(*) as count 
+		from scans group by scan_type order by scan_type`
+	stats := GlobalStats{}
+	err := db.Get(&stats.Files, files_query)
+	checkError(err)
+	err = db.Get(&stats.Messages, messages_query)
+	checkError(err)
+	err = db.Get(&stats.Photos, photos_query)
+	checkError(err)
+	stats.ScansByType = []ScanTypeCount{}
+	err = db.Select(&stats.ScansByType, scans_by_type_query)
+	checkError(err)
+	return stats
+}
+
+// Totals of the files of a local scan under each of its roots.
+func GetScanRootsFromDb(scanId int) []RootStats {
+	read_row := `select root, count(*) as count, COALESCE(sum(size), 0) as size 
+		from scandata 
+		where scan_id = $1 and is_dir = false and root is not null 
+		group by root order by root`
+	roots := []RootStats{}
+	err := db.Select(&roots, read_row, scanId)
+	checkError(err)
+	return roots
+}
+
+// Compares the file count and size recorded for each directory of the scan
+// with those of its immediate children, i.e. its files and the totals recorded
+// for its subdirectories, so each row is only matched with its parent.
+// Returns the number of directories checked and the ones which do not match.
+func GetDirectoryMismatchesFromDb(scanId int) (int, []DirectoryMismatch) {
+	count_rows := `select count(*) from scandata where scan_id = $1 and is_dir = true`
+	read_row := `with C as (
+		  select regexp_replace(path, '/[^/]*$', '') as parent, root,
+			  case when is_dir then COALESCE(file_count, 0) else 1 end as file_count, COALESCE(size, 0) as size 
+		  from scandata where scan_id = $1)
+		select D.path, COALESCE(D.file_count, 0) as file_count, COALESCE(D.size, 0) as size, 
+			COALESCE(sum(C.file_count), 0) as actual_file_count, COALESCE(sum(C.size), 0) as actual_size 
+		from scandata D LEFT JOIN C 
+		  ON C.parent = D.path and C.root IS NOT DISTINCT FROM D.root 
+		where D.scan_id = $1 and D.is_dir = true 
+		group by D.id, D.path, D.file_count, D.size 
+		having COALESCE(D.file_count, 0) <> COALESCE(sum(C.file_count), 0) or COALESCE(D.size, 0) <> COALESCE(sum(C.size), 0) 
+		order by D.path`
+	var count int
+	err := db.Get(&count, count_rows, scanId)
+	checkError(err)
+	mismatches := []DirectoryMismatch{}
+	err = db.Select(&mismatches, read_row, scanId)
+	checkError(err)
+	return count, mismatches
+}
+
+// Reads up to limit rows of the scan with id greater than afterId.
+// Used to iterate over all the rows of a scan in batches.
+func GetScanDataBatchFromDb(scanId int, afterId int, limit int) []ScanData {
+	read_row := `select * from scandata where scan_id = $1 and id > $2 order by id limit $3`
+	scandata := []ScanData{}
+	err := db.Select(&scandata, read_row, scanId, afterId, limit)
+	checkError(err)
+	return scandata
+}
+
+func GetMessageMetadataBatchFromDb(scanId int, afterId int, limit int) []MessageMetadataRead {
+	read_row := `select id, message_id, thread_id, date, mail_from, mail_to,
+							 subject, size_estimate, labels, label_names, scan_id
+	             from messagemetadata 
+							 where scan_id = $1 and id > $2 order by id limit $3`
+	messageMetadata := []MessageMetadataRead{}
+	err := db.Select(&messageMetadata, read_row, scanId, afterId, limit)
+	checkError(err)
+	return messageMetadata
+}
+
+func GetPhotosMediaItemBatchFromDb(scanId int, afterId int, limit int) []PhotosMediaItemRead {
+	read_row := `select id, media_item_id, product_url, mime_type, filename,
+								size, file_mod_time, md5hash, scan_id, contributor_display_name,
+								contributor_profile_url, latitude, longitude 
+								from photosmediaitem 
+							 where scan_id = $1 and id > $2 order by id limit $3`
+	photosMediaItemRead := []PhotosMediaItemRead{}
+	err := db.Select(&photosMediaItemRead, read_row, scanId, afterId, limit)
+	checkError(err)
+	return photosMediaItemRead
+}
+
+// Files of the scans whose name contains query, most recent first. With an
+// account only the scans of that account are searched.
+func SearchScanDataFromDb(query string, account string, limit int) []SearchResult {
+	read_row := `select 'file' as type, D.id, D.scan_id, D.name, D.path as detail 
+		from scandata D LEFT JOIN scanmetadata SM ON D.scan_id = SM.scan_id 
+		where D.name ILIKE $1 and ($2 = '' or SM.account_key = $2) 
+		order by D.id desc limit $3`
+	return search(read_row, query, account, limit)
+}
+
+// Messages whose subject contains query, most recent first.
+func SearchMessageMetadataFromDb(query string, account string, limit int) []SearchResult {
+	read_row := `select 'message' as type, M.id, M.scan_id, M.subject as name, M.mail_from as detail 
+		from messagemetadata M LEFT JOIN scanmetadata SM ON M.scan_id = SM.scan_id 
+		where M.subject ILIKE $1 and ($2 = '' or SM.account_key = $2) 
+		order by M.id desc limit $3`
+	return search(read_row, query, account, limit)
+}
+
+// Media items whose filename contains query, most recent first.
+func SearchPhotosMediaItemFromDb(query string, account string, limit int) []SearchResult {
+	read_row := `select 'photo' as type, P.id, P.scan_id, P.filename as name, P.mime_type as detail 
+		from photosmediaitem P LEFT JOIN scanmetadata SM ON P.scan_id = SM.scan_id 
+		where P.filename ILIKE $1 and ($2 = '' or SM.account_key = $2) 
+		order by P.id desc limit $3`
+	return search(read_row, query, account, limit)
+}
+
+func search(read_row string, query string, account string, limit int) []SearchResult {
+	// The wildcards of LIKE in query are matched literally.
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+	results := []SearchResult{}
+	err := db.Select(&results, read_row, pattern, account, limit)
+	checkError(err)
+	return results
+}
+
+// Deletes the scan along with all its rows in a single transaction.
 func DeleteScan(scanId int) {
-	delete_scandata := `delete from scandata
+	tx, err := db.Beginx()
+	checkError(err)
+	defer tx.Rollback()
+	deleteScanRows(tx, scanId)
+
+	delete_scanmetadata := `delete from scanmetadata
 	where scan_id = $1`
-	_, err := db.Exec(delete_scandata, scanId)
+	_, err = tx.Exec(delete_scanmetadata, scanId)
 	checkError(err)
 
-	delete_messagemetadata := `delete from messagemetadata
+	delete_scans := `delete from scans
+	where id = $1`
+	_, err = tx.Exec(delete_scans, scanId)
+	checkError(err)
+	checkError(tx.Commit())
+}
+
+// Deletes the files, messages and media items found by the scan.
+func deleteScanRows(tx *sqlx.Tx, scanId int) {
+	delete_scandata := `delete from scandata
 	where scan_id = $1`
-	_, err = db.Exec(delete_messagemetadata, scanId)
+	_, err := tx.Exec(delete_scandata, scanId)
 	checkError(err)
 
-	delete_scanmetadata := `delete from scanmetadata
+	delete_messagemetadata := `delete from messagemetadata
 	where scan_id = $1`
-	_, err = db.Exec(delete_scanmetadata, scanId)
+	_, err = tx.Exec(delete_messagemetadata, scanId)
 	checkError(err)
 
 	delete_photometadata := `delete from photometadata
 	where photos_media_item_id IN (select id from 
 		photosmediaitem where scan_id = $1)`
-	_, err = db.Exec(delete_photometadata, scanId)
+	_, err = tx.Exec(delete_photometadata, scanId)
 	checkError(err)
 
 	delete_videometadata := `delete from videometadata
 	where photos_media_item_id IN (select id from 
 		photosmediaitem where scan_id = $1)`
-	_, err = db.Exec(delete_videometadata, scanId)
+	_, err = tx.Exec(delete_videometadata, scanId)
 	checkError(err)
 
 	delete_photosmediaitem := `delete from photosmediaitem
 	where scan_id = $1`
-	_, err = db.Exec(delete_photosmediaitem, scanId)
+	_, err = tx.Exec(delete_photosmediaitem, scanId)
 	checkError(err)
+}
 
-	delete_scans := `delete from scans
-	where id = $1`
-	_, err = db.Exec(delete_scans, scanId)
+// Deletes the rows of the older completed scans of the same source and
+// account as scanId, keeping those of the latest keep scans. The scans and
+// their metadata stay listed, marked as compacted. Local and storage scans
+// have no account. The scans of Google APIs whose account is not known are
+// never compacted, as they can not be told apart by account. Returns the ids
+// of the compacted scans.
+func CompactScans(scanId int, keep int) []int {
+	read_row := `select S.id from scans S JOIN scanmetadata SM ON S.id = SM.scan_id 
+		JOIN scans T ON T.id = $1 JOIN scanmetadata TM ON T.id = TM.scan_id 
+		where S.scan_type = T.scan_type 
+		  and SM.account_key IS NOT DISTINCT FROM TM.account_key 
+		  and (TM.account_key IS NOT NULL or T.scan_type in ('local', 'google_storage')) 
+		  and SM.search_path IS NOT DISTINCT FROM TM.search_path 
+		  and SM.search_filter IS NOT DISTINCT FROM TM.search_filter 
+		  and COALESCE(S.status, 'Completed') in ('Completed', 'CompletedWithWarning') 
+		  and S.compacted_on IS NULL 
+		order by S.id desc OFFSET $2`
+	scanIds := []int{}
+	err := db.Select(&scanIds, read_row, scanId, keep)
 	checkError(err)
+	for _, compactScanId := range scanIds {
+		compactScan(compactScanId)
+	}
+	return scanIds
 }
 
-func logCompleteScan(scanId int) {
+func compactScan(scanId int) {
+	tx, err := db.Beginx()
+	checkError(err)
+	defer tx.Rollback()
+	deleteScanRows(tx, scanId)
+	update_row := `update scans set compacted_on = current_timestamp where id = $1`
+	_, err = tx.Exec(update_row, scanId)
+	checkError(err)
+	checkError(tx.Commit())
+}
+
+// Marks a running scan as finished. Scans which were cancelled or have
+// failed in the meantime keep their status.
+func LogCompleteScan(scanId int) {
 	update_row := `update scans 
-								 set scan_end_time = current_timestamp 
-								 where id = $1`
+								 set scan_end_time = current_timestamp,
+								 status = CASE WHEN status_msg IS NULL 
+								   THEN 'Completed' ELSE 'CompletedWithWarning' END 
+								 where id = $1 and COALESCE(status, 'Running') = 'Running'`
 	res, err := db.Exec(update_row, scanId)
 	checkError(err)
 	count, err := res.RowsAffected()
 	checkError(err)
 	if count != 1 {
-		fmt.Printf("Could not perform update. query=%s, expected:%d actual: %d", update_row, 1, count)
+		fmt.Printf("Scan was not running. Not marking scanId=%d as completed.\n", scanId)
 	}
 }
 
+func MarkScanCancelled(scanId int) {
+	update_row := `update scans 
+								 set scan_end_time = current_timestamp, status = 'Cancelled' 
+								 where id = $1 and status = 'Running'`
+	_, err := db.Exec(update_row, scanId)
+	checkError(err)
+}
+
+// Marks the scan as Failed with the reason for the failure.
+func MarkScanFailed(scanId int, errorCategory string, errorMsg string) {
+	update_row := `update scans 
+								 set scan_end_time = current_timestamp, status = 'Failed', status_msg = $1, 
+								 error_category = $2 
+								 where id = $3`
+	_, err := db.Exec(update_row, errorMsg, errorCategory, scanId)
+	checkError(err)
+}
+
 func migrateDB() {
 	var count int
 	var version int
@@ -269,7 +758,6 @@ func migrateDB() {
 	checkError(err)
 	if count == 0 {
 		migrateDBv0()
-		return
 	}
 	select_version_table := `select COALESCE(MAX(id),0) from version`
 	err = db.Get(&version, select_version_table)
@@ -284,6 +772,45 @@ func migrateDB() {
 	if version < 4 {
 		migrateDBv3To4()
 	}
+	if version < 5 {
+		migrateDBv4To5()
+	}
+	if version < 6 {
+		migrateDBv5To6()
+	}
+	if version < 7 {
+		migrateDBv6To7()
+	}
+	if version < 8 {
+		migrateDBv7To8()
+	}
+	if version < 9 {
+		migrateDBv8To9()
+	}
+	if version < 10 {
+		migrateDBv9To10()
+	}
+	if version < 11 {
+		migrateDBv10To11()
+	}
+	if version < 12 {
+		migrateDBv11To12()
+	}
+	if version < 13 {
+		migrateDBv12To13()
+	}
+	if version < 14 {
+		migrateDBv13To14()
+	}
+	if version < 15 {
+		migrateDBv14To15()
+	}
+	if version < 16 {
+		migrateDBv15To16()
+	}
+	if version < 17 {
+		migrateDBv16To17()
+	}
 }
 
 func migrateDBv0() {
@@ -343,6 +870,147 @@ func migrateDBv3To4() {
 	db.MustExec(insert_version_table)
 }
 
+func migrateDBv4To5() {
+	insert_version_table := `delete from version; 
+		INSERT INTO version (id) VALUES (5)`
+	add_label_names_column := `ALTER TABLE messagemetadata 
+		ADD COLUMN IF NOT EXISTS label_names VARCHAR(1000)`
+	db.MustExec(add_label_names_column)
+	db.MustExec(insert_version_table)
+}
+
+func migrateDBv5To6() {
+	insert_version_table := `delete from version; 
+		INSERT INTO version (id) VALUES (6)`
+	add_scans_status_columns := `ALTER TABLE scans 
+		ADD COLUMN IF NOT EXISTS status VARCHAR(50),
+		ADD COLUMN IF NOT EXISTS status_msg TEXT`
+	add_scanmetadata_checkpoint_columns := `ALTER TABLE scanmetadata 
+		ADD COLUMN IF NOT EXISTS page_token TEXT,
+		ADD COLUMN IF NOT EXISTS items_processed INT`
+	db.MustExec(add_scans_status_columns)
+	db.MustExec(add_scanmetadata_checkpoint_columns)
+	db.MustExec(insert_version_table)
+}
+
+func migrateDBv6To7() {
+	insert_version_table := `delete from version; 
+		INSERT INTO version (id) VALUES (7)`
+	add_hash_skipped_column := `ALTER TABLE scandata 
+		ADD COLUMN IF NOT EXISTS hash_skipped boolean`
+	db.MustExec(add_hash_skipped_column)
+	db.MustExec(insert_version_table)
+}
+
+func migrateDBv7To8() {
+	insert_version_table := `delete from version; 
+		INSERT INTO version (id) VALUES (8)`
+	create_messagemetadata_index := `CREATE INDEX IF NOT EXISTS messagemetadata_scan_id_message_id 
+		ON messagemetadata (scan_id, message_id)`
+	db.MustExec(create_messagemetadata_index)
+	db.MustExec(insert_version_table)
+}
+
+func migrateDBv8To9() {
+	insert_version_table := `delete from version; 
+		INSERT INTO version (id) VALUES (9)`
+	add_location_columns := `ALTER TABLE photosmediaitem 
+		ADD COLUMN IF NOT EXISTS latitude double precision,
+		ADD COLUMN IF NOT EXISTS longitude double precision`
+	db.MustExec(add_location_columns)
+	db.MustExec(insert_version_table)
+}
+
+func migrateDBv9To10() {
+	insert_version_table := `delete from version; 
+		INSERT INTO version (id) VALUES (10)`
+	add_error_category_column := `ALTER TABLE scans 
+		ADD COLUMN IF NOT EXISTS error_category VARCHAR(20)`
+	db.MustExec(add_error_category_column)
+	db.MustExec(insert_version_table)
+}
+
+func migrateDBv10To11() {
+	insert_version_table := `delete from version; 
+		INSERT INTO version (id) VALUES (11)`
+	add_root_column := `ALTER TABLE scandata 
+		ADD COLUMN IF NOT EXISTS root VARCHAR(2000)`
+	db.MustExec(add_root_column)
+	db.MustExec(insert_version_table)
+}
+
+func migrateDBv11To12() {
+	insert_version_table := `delete from version; 
+		INSERT INTO version (id) VALUES (12)`
+	add_contributor_profile_url_column := `ALTER TABLE photosmediaitem 
+		ADD COLUMN IF NOT EXISTS contributor_profile_url TEXT`
+	db.MustExec(add_contributor_profile_url_column)
+	db.MustExec(insert_version_table)
+}
+
+func migrateDBv12To13() {
+	insert_version_table := `delete from version; 
+		INSERT INTO version (id) VALUES (13)`
+	add_account_key_column := `ALTER TABLE scanmetadata 
+		ADD COLUMN IF NOT EXISTS account_key VARCHAR(64)`
+	add_compacted_on_column := `ALTER TABLE scans 
+		ADD COLUMN IF NOT EXISTS compacted_on TIMESTAMP`
+	db.MustExec(add_account_key_column)
+	db.MustExec(add_compacted_on_column)
+	db.MustExec(insert_version_table)
+}
+
+// Makes room for hashes longer than MD5, e.g. 64 hex digits of SHA-256.
+// Changing VARCHAR to TEXT does not rewrite the table, and changing TEXT to
+// TEXT again is a no-op.
+func migrateDBv13To14() {
+	insert_version_table := `delete from version; 
+		INSERT INTO version (id) VALUES (14)`
+	widen_md5hash_column := `ALTER TABLE scandata 
+		ALTER COLUMN md5hash TYPE TEXT`
+	db.MustExec(widen_md5hash_column)
+	db.MustExec(insert_version_table)
+}
+
+func migrateDBv14To15() {
+	insert_version_table := `delete from version; 
+		INSERT INTO version (id) VALUES (15)`
+	add_roots_column := `ALTER TABLE scanmetadata 
+		ADD COLUMN IF NOT EXISTS roots TEXT[]`
+	db.MustExec(add_roots_column)
+	db.MustExec(insert_version_table)
+}
+
+// The accounts are identified by their email address instead of a hash of
+// their token. The hashes can not be mapped to an account, so the scans
+// recorded with them are taken as recorded before the account was stored.
+// compacted_on is an absolute time, the other timestamps are stored in UTC.
+func migrateDBv15To16() {
+	insert_version_table := `delete from version; 
+		INSERT INTO version (id) VALUES (16)`
+	widen_account_key_column := `ALTER TABLE scanmetadata 
+		ALTER COLUMN account_key TYPE VARCHAR(320)`
+	clear_account_keys := `update scanmetadata set account_key = NULL 
+		where account_key NOT LIKE '%@%'`
+	compacted_on_with_time_zone := `ALTER TABLE scans 
+		ALTER COLUMN compacted_on TYPE TIMESTAMPTZ USING compacted_on AT TIME ZONE 'UTC'`
+	db.MustExec(widen_account_key_column)
+	db.MustExec(clear_account_keys)
+	db.MustExec(compacted_on_with_time_zone)
+	db.MustExec(insert_version_table)
+}
+
+// The messages are fetched concurrently, so their ids are not in the order
+// of the messages.
+func migrateDBv16To17() {
+	insert_version_table := `delete from version; 
+		INSERT INTO version (id) VALUES (17)`
+	add_internal_date_column := `ALTER TABLE messagemetadata 
+		ADD COLUMN IF NOT EXISTS internal_date TIMESTAMPTZ`
+	db.MustExec(add_internal_date_column)
+	db.MustExec(insert_version_table)
+}
+
 const create_scanmetadata_table string = `CREATE TABLE IF NOT EXISTS scanmetadata (
 	id serial PRIMARY KEY,
 	name VARCHAR(200),
@@ -363,6 +1031,7 @@ const create_messagemetadata_table string = `CREATE TABLE IF NOT EXISTS messagem
 	subject VARCHAR(2000),
 	size_estimate BIGINT,
 	labels VARCHAR(500),
+	label_names VARCHAR(1000),
 	scan_id INT NOT NULL,
 	FOREIGN KEY (scan_id)
 		REFERENCES Scans (id)
@@ -407,51 +1076,144 @@ const create_videometadata_table string = `CREATE TABLE IF NOT EXISTS videometad
 )`
 
 type Scan struct {
-	Id            int          `db:"id" json:"scan_id"`
-	ScanType      string       `db:"scan_type"`
-	CreatedOn     time.Time    `db:"created_on"`
-	ScanStartTime time.Time    `db:"scan_start_time"`
-	ScanEndTime   sql.NullTime `db:"scan_end_time"`
-	Metadata      string       `db:"metadata"`
-	Duration      string       `db:"duration"`
+	Id            int       `db:"id" json:"scan_id"`
+	ScanType      string    `db:"scan_type"`
+	CreatedOn     time.Time `db:"created_on"`
+	ScanStartTime time.Time `db:"scan_start_time"`
+	ScanEndTime   NullTime  `db:"scan_end_time"`
+	Metadata      string    `db:"metadata"`
+	Duration      string    `db:"duration"`
+	// One of Running, Completed, CompletedWithWarning, Failed or Cancelled.
+	// Not set for the scans created before status was tracked.
+	Status    NullString `db:"status"`
+	StatusMsg NullString `db:"status_msg"`
+	// One of AUTH, QUOTA, NETWORK, DB, VALIDATION or UNKNOWN for Failed scans,
+	// and for the scans which completed with a warning caused by an error.
+	ErrorCategory NullString `db:"error_category"`
+	// Set once the rows of the scan were deleted to retain only the latest
+	// scans of its source.
+	CompactedOn NullTime `db:"compacted_on"`
+}
+
+// A file, message or media item matching a search. Name is the file name,
+// the subject or the filename. Detail is the path of a file, the sender of
+// a message or the mime type of a media item.
+type SearchResult struct {
+	Type   string     `db:"type" json:"type"`
+	Id     int        `db:"id" json:"id"`
+	ScanId int        `db:"scan_id" json:"scan_id"`
+	Name   NullString `db:"name" json:"name"`
+	Detail NullString `db:"detail" json:"detail"`
 }
 
+type ScanCheckpoint struct {
+	ScanType     string         `db:"scan_type"`
+	Status       sql.NullString `db:"status"`
+	SearchPath   sql.NullString `db:"search_path"`
+	SearchFilter sql.NullString `db:"search_filter"`
+	// Directories of local scans. Not set for the scans created before they
+	// were stored, which only had a single directory.
+	Roots pq.StringArray `db:"roots"`
+	// Email address of the account of the scans of Google APIs, when known.
+	AccountKey     sql.NullString `db:"account_key"`
+	PageToken      sql.NullString `db:"page_token"`
+	ItemsProcessed sql.NullInt64  `db:"items_processed"`
+}
+
+// A file hashed by an earlier scan.
+type HashedFile struct {
+	Path         string    `db:"path"`
+	Size         int64     `db:"size"`
+	ModifiedTime time.Time `db:"file_mod_time"`
+	Md5Hash      string    `db:"md5hash"`
+}
+
+// ScanData is a file or directory found by a local, google_drive or
+// google_storage scan. The meaning of some fields depends on the scan type.
+//   - Path is the absolute file path for local, the file id for
+//     google_drive and the media link of the object for google_storage.
+//   - IsDir and FileCount are only set for directories of local scans.
+//     Drive and storage scans only record files.
+//   - Size of a local directory is the total size of all the files under it.
 type ScanData struct {
-	Id           int            `db:"id" json:"scan_data_id"`
-	Name         sql.NullString `db:"name"`
-	Path         sql.NullString `db:"path"`
-	Size         sql.NullInt64  `db:"size"`
-	ModifiedTime sql.NullTime   `db:"file_mod_time"`
-	Md5Hash      sql.NullString `db:"md5hash"`
-	IsDir        sql.NullBool   `db:"is_dir"`
-	FileCount    sql.NullInt32  `db:"file_count"`
-	ScanId       int            `db:"scan_id"`
+	Id           int        `db:"id" json:"scan_data_id"`
+	Name         NullString `db:"name"`
+	Path         NullString `db:"path"`
+	Size         NullInt64  `db:"size"`
+	ModifiedTime NullTime   `db:"file_mod_time"`
+	Md5Hash      NullString `db:"md5hash"`
+	IsDir        NullBool   `db:"is_dir"`
+	FileCount    NullInt32  `db:"file_count"`
+	ScanId       int        `db:"scan_id"`
+	HashSkipped  NullBool   `db:"hash_skipped"`
+	Root         NullString `db:"root"`
 }
 
 type MessageMetadataRead struct {
-	Id           int            `db:"id" json:"message_metadata_id"`
-	ScanId       int            `db:"scan_id"`
-	MessageId    sql.NullString `db:"message_id"`
-	ThreadId     sql.NullString `db:"thread_id"`
-	LabelIds     sql.NullString `db:"labels"`
-	From         sql.NullString `db:"mail_from"`
-	To           sql.NullString `db:"mail_to"`
-	Subject      sql.NullString
-	Date         sql.NullString
-	SizeEstimate sql.NullInt64 `db:"size_estimate"`
+	Id           int        `db:"id" json:"message_metadata_id"`
+	ScanId       int        `db:"scan_id"`
+	MessageId    NullString `db:"message_id"`
+	ThreadId     NullString `db:"thread_id"`
+	LabelIds     NullString `db:"labels"`
+	LabelNames   NullString `db:"label_names"`
+	From         NullString `db:"mail_from"`
+	To           NullString `db:"mail_to"`
+	Subject      NullString
+	Date         MailDate
+	SizeEstimate NullInt64 `db:"size_estimate"`
+}
+
+type MessageThread struct {
+	ThreadId      NullString `db:"thread_id"`
+	MessageCount  int        `db:"message_count"`
+	TotalSize     int64      `db:"total_size"`
+	LatestSubject NullString `db:"latest_subject"`
+}
+
+type GlobalStats struct {
+	Files       ItemStats       `json:"files"`
+	Messages    ItemStats       `json:"messages"`
+	Photos      ItemStats       `json:"photos"`
+	ScansByType []ScanTypeCount `json:"scans_by_type"`
+}
+
+type ItemStats struct {
+	Count int   `db:"count" json:"count"`
+	Size  int64 `db:"size" json:"size"`
+}
+
+type DirectoryMismatch struct {
+	Path            string `db:"path" json:"path"`
+	FileCount       int64  `db:"file_count" json:"file_count"`
+	ActualFileCount int64  `db:"actual_file_count" json:"actual_file_count"`
+	Size            int64  `db:"size" json:"size"`
+	ActualSize      int64  `db:"actual_size" json:"actual_size"`
+}
+
+type RootStats struct {
+	Root string `db:"root" json:"root"`
+	ItemStats
+}
+
+type ScanTypeCount struct {
+	ScanType string `db:"scan_type" json:"scan_type"`
+	Count    int    `db:"count" json:"count"`
 }
 
 type PhotosMediaItemRead struct {
-	Id                     int            `db:"id" json:"photos_media_item_id"`
-	ScanId                 int            `db:"scan_id"`
-	MediaItemId            string         `db:"media_item_id" json:"media_item_id"`
-	ProductUrl             string         `db:"product_url"`
-	MimeType               sql.NullString `db:"mime_type"`
+	Id                     int        `db:"id" json:"photos_media_item_id"`
+	ScanId                 int        `db:"scan_id"`
+	MediaItemId            string     `db:"media_item_id" json:"media_item_id"`
+	ProductUrl             string     `db:"product_url"`
+	MimeType               NullString `db:"mime_type"`
 	Filename               string
-	Size                   sql.NullInt64
-	ModifiedTime           sql.NullTime `db:"file_mod_time"`
-	Md5hash                sql.NullString
-	ContributorDisplayName sql.NullString `db:"contributor_display_name"`
+	Size                   NullInt64
+	ModifiedTime           NullTime `db:"file_mod_time"`
+	Md5hash                NullString
+	ContributorDisplayName NullString `db:"contributor_display_name"`
+	ContributorProfileUrl  NullString `db:"contributor_profile_url"`
+	Latitude               NullFloat64
+	Longitude              NullFloat64
 }
 
 func substr(s string, end int) string {
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Set when the database of the server can be reached. The tests which need
+// it are skipped otherwise.
+var dbAvailable bool
+
+func TestMain(m *testing.M) {
+	if err := setup(); err != nil {
+		fmt.Printf("Skipping the tests which need a database. err=%v\n", err)
+	} else {
+		dbAvailable = true
+	}
+	os.Exit(m.Run())
+}
+
+func requireDb(t *testing.T) {
+	t.Helper()
+	if !dbAvailable {
+		t.Skip("database is not available")
+	}
+}
+
+func TestGetMessageThreadsFromDbLatestSubject(t *testing.T) {
+	requireDb(t)
+	scanId := LogStartScan("gmail")
+	defer DeleteScan(scanId)
+	received := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	// Inserted in another order than they were received, as the messages of
+	// a scan are fetched concurrently.
+	messages := []MessageMetadata{
+		{MessageId: "m2", ThreadId: "t1", Subject: "Re: second", InternalDate: received.Add(time.Hour)},
+		{MessageId: "m3", ThreadId: "t1", Subject: "Re: third", InternalDate: received.Add(2 * time.Hour)},
+		{MessageId: "m1", ThreadId: "t1", Subject: "first", InternalDate: received},
+	}
+	for _, md := range messages {
+		if err := SaveMessageMetadataToDb(scanId, md); err != nil {
+			t.Fatal(err)
+		}
+	}
+	threads, count := GetMessageThreadsFromDb(scanId, 1)
+	if count != 1 || len(threads) != 1 {
+		t.Fatalf("got %v threads of %v, want 1", len(threads), count)
+	}
+	if threads[0].MessageCount != 3 {
+		t.Errorf("got %v messages, want 3", threads[0].MessageCount)
+	}
+	if got := threads[0].LatestSubject.String; got != "Re: third" {
+		t.Errorf("got latest subject %q, want %q", got, "Re: third")
+	}
+}
+
+func TestGetScansBySourceFromDbMatchesRoots(t *testing.T) {
+	requireDb(t)
+	roots := []string{"/tmp/bhandaar-test/a", "/tmp/bhandaar-test/b"}
+	scanId := LogStartScan("local")
+	defer DeleteScan(scanId)
+	SaveScanMetadata("dir="+strings.Join(roots, ":"), "", "", scanId)
+	SaveScanRoots(scanId, roots)
+	for _, path := range []string{"/tmp/bhandaar-test/a", "/tmp/bhandaar-test/b/"} {
+		scans, _ := GetScansBySourceFromDb(path, "", 1)
+		found := false
+		for _, scan := range scans {
+			found = found || scan.Id == scanId
+		}
+		if !found {
+			t.Errorf("scanId=%v not listed for path %q", scanId, path)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Reports whether err was returned by the database server.
+func IsDatabaseError(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr)
+}
+
+// Reports whether the statement failed for a reason which can go away when it
+// is executed again, e.g. a deadlock or a dropped connection. Constraint
+// violations and other errors caused by the data itself are not transient.
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"53300", // too_many_connections
+			"55P03", // lock_not_available
+			"57P01": // admin_shutdown
+			return true
+		}
+		// Class 08 is connection exceptions.
+		return strings.HasPrefix(string(pqErr.Code), "08")
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/mail"
+	"time"
+)
+
+// The Null types wrap their sql counterparts so that they are serialized to
+// JSON as null or as the bare value instead of as an object with Valid.
+
+type NullString struct {
+	sql.NullString
+}
+
+func (s NullString) MarshalJSON() ([]byte, error) {
+	if !s.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(s.String)
+}
+
+type NullInt64 struct {
+	sql.NullInt64
+}
+
+func (i NullInt64) MarshalJSON() ([]byte, error) {
+	if !i.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(i.Int64)
+}
+
+type NullInt32 struct {
+	sql.NullInt32
+}
+
+func (i NullInt32) MarshalJSON() ([]byte, error) {
+	if !i.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(i.Int32)
+}
+
+type NullBool struct {
+	sql.NullBool
+}
+
+func (b NullBool) MarshalJSON() ([]byte, error) {
+	if !b.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(b.Bool)
+}
+
+type NullFloat64 struct {
+	sql.NullFloat64
+}
+
+func (f NullFloat64) MarshalJSON() ([]byte, error) {
+	if !f.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(f.Float64)
+}
+
+// NullTime is serialized as the time in RFC 3339 format in UTC.
+// The timestamps are stored in UTC.
+type NullTime struct {
+	sql.NullTime
+}
+
+func (t NullTime) MarshalJSON() ([]byte, error) {
+	if !t.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.Time.UTC().Format(time.RFC3339))
+}
+
+// MailDate is the Date header of a message as stored. It is serialized in
+// RFC 3339 format in UTC like the other timestamps, or as is when the header
+// can not be parsed.
+type MailDate struct {
+	sql.NullString
+}
+
+func (d MailDate) MarshalJSON() ([]byte, error) {
+	if !d.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(d.Format())
+}
+
+func (d MailDate) Format() string {
+	date, err := mail.ParseDate(d.String)
+	if err != nil {
+		return d.String
+	}
+	return date.UTC().Format(time.RFC3339)
+}
@@ -12,16 +12,23 @@ type FileData struct {
 	ModTime   time.Time
 	FileCount uint
 	Md5Hash   string
+	// Set when hashing was skipped because the file is too large.
+	HashSkipped bool
+	// Directory of a local scan under which the file was found.
+	Root string
 }
 
 type MessageMetadata struct {
-	MessageId    string
-	ThreadId     string
-	LabelIds     []string
-	From         string
-	To           string
-	Subject      string
-	Date         string
+	MessageId  string
+	ThreadId   string
+	LabelIds   []string
+	LabelNames []string
+	From       string
+	To         string
+	Subject    string
+	Date       string
+	// Time Gmail received the message. Unlike Date it is set on every message.
+	InternalDate time.Time
 	SizeEstimate int64
 }
 
@@ -34,6 +41,7 @@ type PhotosMediaItem struct {
 	FileModTime            time.Time
 	Md5hash                string
 	ContributorDisplayName string
+	ContributorProfileUrl  string
 	AlbumIds               []string
 	CameraMake             string
 	CameraModel            string
@@ -42,4 +50,6 @@ type PhotosMediaItem struct {
 	Iso                    int
 	ExposureTime           string
 	Fps                    float32
+	Latitude               NullFloat64
+	Longitude              NullFloat64
 }
@@ -2,12 +2,17 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/jyothri/hdd/collect"
+	"github.com/jyothri/hdd/constants"
 	"github.com/jyothri/hdd/db"
 )
 
@@ -17,19 +22,141 @@ func api(r *mux.Router) {
 	api.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]bool{"ok": true})
 	})
+	// Liveness: the process is up and serving requests.
+	api.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+	})
+	// Readiness: the database is reachable and migrated.
+	api.HandleFunc("/readyz", ReadinessHandler)
+	if constants.EnableConfigEndpoint {
+		api.HandleFunc("/config", ConfigHandler).Methods("GET")
+	}
+	api.HandleFunc("/stats/global", GlobalStatsHandler).Methods("GET")
+	api.HandleFunc("/admin/cancel-all", CancelAllScansHandler).Methods("POST")
+	api.HandleFunc("/progress", ProgressHandler).Methods("GET").Queries("scan_id", "{scan_id}")
+	api.HandleFunc("/progress", ProgressHandler).Methods("GET")
 	api.HandleFunc("/scans", DoScansHandler).Methods("POST")
+	api.HandleFunc("/scans/rerun-batch", RerunScansHandler).Methods("POST")
 	api.HandleFunc("/scans/{scan_id}", DeleteScanHandler).Methods("DELETE")
+	api.HandleFunc("/scans/{scan_id}/export/sheets", ExportToSheetsHandler).Methods("POST")
+	api.HandleFunc("/scans/{scan_id}/export/sheets", ExportStatusHandler).Methods("GET")
+	api.HandleFunc("/scans/{scan_id}/roots", ListScanRootsHandler).Methods("GET")
+	api.HandleFunc("/scans/{scan_id}/validate", ValidateScanHandler).Methods("GET")
 	api.HandleFunc("/scans", ListScansHandler).Methods("GET").Queries("page", "{page}")
 	api.HandleFunc("/scans", ListScansHandler).Methods("GET")
+	api.HandleFunc("/scans/by-source", ListScansBySourceHandler).Methods("GET").Queries("page", "{page}")
+	api.HandleFunc("/scans/by-source", ListScansBySourceHandler).Methods("GET")
 	api.HandleFunc("/scans/{scan_id}", ListScanDataHandler).Methods("GET").Queries("page", "{page}")
 	api.HandleFunc("/scans/{scan_id}", ListScanDataHandler).Methods("GET")
+	api.HandleFunc("/search", SearchHandler).Methods("GET").Queries("q", "{q}")
+	api.HandleFunc("/gmaildata/preview", PreviewGmailFilterHandler).Methods("GET").Queries("refresh_token", "{refresh_token}")
 	api.HandleFunc("/gmaildata/{scan_id}", ListMessageMetaDataHandler).Methods("GET").Queries("page", "{page}")
 	api.HandleFunc("/gmaildata/{scan_id}", ListMessageMetaDataHandler).Methods("GET")
+	api.HandleFunc("/gmaildata/{scan_id}/threads", ListMessageThreadsHandler).Methods("GET").Queries("page", "{page}")
+	api.HandleFunc("/gmaildata/{scan_id}/threads", ListMessageThreadsHandler).Methods("GET")
+	api.HandleFunc("/photos/albums", ListAlbumsHandler).Methods("GET").Queries("refresh_token", "{refresh_token}", "max_albums", "{max_albums}")
 	api.HandleFunc("/photos/albums", ListAlbumsHandler).Methods("GET").Queries("refresh_token", "{refresh_token}")
+	api.HandleFunc("/photos/albums/{album_id}", GetAlbumHandler).Methods("GET").Queries("refresh_token", "{refresh_token}")
+	api.HandleFunc("/photos/{scan_id}/item/{id}/download", DownloadPhotoHandler).Methods("GET").Queries("refresh_token", "{refresh_token}")
 	api.HandleFunc("/photos/{scan_id}", ListPhotosHandler).Methods("GET").Queries("page", "{page}")
 	api.HandleFunc("/photos/{scan_id}", ListPhotosHandler).Methods("GET")
 }
 
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	setJsonHeader(w)
+	if err := db.Ready(); err != nil {
+		fmt.Printf("Not ready: %v\n", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
+
+// Global stats scan entire tables. They are cached for a short duration.
+const globalStatsTtl = time.Minute
+
+var globalStatsCache struct {
+	sync.Mutex
+	stats     db.GlobalStats
+	fetchedAt time.Time
+}
+
+func GlobalStatsHandler(w http.ResponseWriter, r *http.Request) {
+	globalStatsCache.Lock()
+	if time.Since(globalStatsCache.fetchedAt) > globalStatsTtl {
+		globalStatsCache.stats = db.GetGlobalStatsFromDb()
+		globalStatsCache.fetchedAt = time.Now()
+	}
+	stats := globalStatsCache.stats
+	globalStatsCache.Unlock()
+	serializedBody, _ := json.Marshal(stats)
+	setJsonHeader(w)
+	_, _ = w.Write(serializedBody)
+}
+
+// Default and maximum number of results of each scan type returned by search.
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// Searches the files, messages and photos of all the scans, or only of the
+// scans of the account when refresh_token is set. limit caps the results of
+// each scan type.
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(mux.Vars(r)["q"])
+	if query == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	limit := defaultSearchLimit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", limitParam), http.StatusBadRequest)
+			return
+		}
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	results, err := collect.Search(query, r.URL.Query().Get("refresh_token"), limit)
+	if err != nil {
+		writeScanError(w, err)
+		return
+	}
+	body := SearchResponse{
+		Query:   query,
+		Limit:   limit,
+		Results: results,
+	}
+	serializedBody, _ := json.Marshal(body)
+	setJsonHeader(w)
+	_, _ = w.Write(serializedBody)
+}
+
+// Responds with the effective settings of the server, to debug a deployment.
+// The client secret and the tokens are never included.
+func ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	body := ConfigResponse{
+		ListenAddr:    listenAddr,
+		WriteTimeout:  writeTimeout.String(),
+		ReadTimeout:   readTimeout.String(),
+		FrontendUrl:   constants.FrontendUrl,
+		CorsMode:      constants.CorsMode,
+		OauthClientId: constants.OauthClientId,
+		OauthTimeout:  constants.OauthTokenTimeout.String(),
+		Database:      db.GetDatabaseInfo(),
+		PageSize:      db.PageSize,
+		Collect:       collect.GetSettings(),
+	}
+	serializedBody, _ := json.Marshal(body)
+	setJsonHeader(w)
+	_, _ = w.Write(serializedBody)
+}
+
 func DoScansHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var doScanRequest DoScanRequest
@@ -38,42 +165,196 @@ func DoScansHandler(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 	fmt.Printf("Received request: %v\n", doScanRequest)
-	var body DoScanResponse
+	scanId := -1
 	switch doScanRequest.ScanType {
 	case "Local":
-		body = DoScanResponse{
-			ScanId: collect.LocalDrive(doScanRequest.LocalScan),
-		}
+		scanId, err = collect.LocalDrive(doScanRequest.LocalScan)
 	case "GDrive":
-		body = DoScanResponse{
-			ScanId: collect.CloudDrive(doScanRequest.GDriveScan),
-		}
+		scanId, err = collect.CloudDrive(doScanRequest.GDriveScan)
 	case "GStorage":
-		body = DoScanResponse{
-			ScanId: collect.CloudStorage(doScanRequest.GStorageScan),
-		}
+		scanId, err = collect.CloudStorage(doScanRequest.GStorageScan)
 	case "GMail":
-		body = DoScanResponse{
-			ScanId: collect.Gmail(doScanRequest.GMailScan),
-		}
+		scanId, err = collect.Gmail(doScanRequest.GMailScan)
 	case "GPhotos":
-		body = DoScanResponse{
-			ScanId: collect.Photos(doScanRequest.GPhotosScan),
-		}
-	default:
-		body = DoScanResponse{
-			ScanId: -1,
+		scanId, err = collect.Photos(doScanRequest.GPhotosScan)
+	}
+	if err != nil {
+		fmt.Printf("Could not start scan: %v\n", err)
+		writeScanError(w, err)
+		return
+	}
+	body := DoScanResponse{
+		ScanId: scanId,
+	}
+	serializedBody, _ := json.Marshal(body)
+	setJsonHeader(w)
+	_, _ = w.Write(serializedBody)
+}
+
+// Scans which can be rerun with a single request.
+const maxRerunBatchSize = 50
+
+// Starts new scans of the sources of the given scans, e.g. to refresh all the
+// accounts. A scan which could not be started is reported with its error and
+// does not stop the others.
+func RerunScansHandler(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var rerunRequests []RerunScanRequest
+	err := decoder.Decode(&rerunRequests)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rerunRequests) > maxRerunBatchSize {
+		http.Error(w, fmt.Sprintf("at most %v scans can be rerun at once", maxRerunBatchSize), http.StatusBadRequest)
+		return
+	}
+	reruns := make([]collect.Rerun, len(rerunRequests))
+	for i, rerunRequest := range rerunRequests {
+		reruns[i] = collect.Rerun{ScanId: rerunRequest.ScanId, RefreshToken: rerunRequest.RefreshToken}
+	}
+	body := RerunScansResponse{Results: []RerunScanResult{}}
+	for _, result := range collect.RerunScans(reruns) {
+		rerunResult := RerunScanResult{ScanId: result.ScanId, NewScanId: result.NewScanId}
+		if result.Err != nil {
+			fmt.Printf("Could not rerun scanId=%v: %v\n", result.ScanId, result.Err)
+			rerunResult.Error = result.Err.Error()
+			var scanErr *collect.ScanError
+			if errors.As(result.Err, &scanErr) {
+				rerunResult.ErrorCategory = string(scanErr.Category)
+			}
 		}
+		body.Results = append(body.Results, rerunResult)
 	}
 	serializedBody, _ := json.Marshal(body)
 	setJsonHeader(w)
 	_, _ = w.Write(serializedBody)
 }
 
+// Responds with a status code based on the category of the failure.
+// The category is also sent in the X-Error-Category header. A scan rejected
+// as a duplicate gets 409 along with the id of the running scan.
+func writeScanError(w http.ResponseWriter, err error) {
+	var duplicateErr *collect.DuplicateScanError
+	if errors.As(err, &duplicateErr) {
+		// The scan which is already running is returned like a started scan.
+		serializedBody, _ := json.Marshal(DoScanResponse{ScanId: duplicateErr.ScanId})
+		setJsonHeader(w)
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write(serializedBody)
+		return
+	}
+	var scanErr *collect.ScanError
+	if !errors.As(err, &scanErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status := http.StatusBadRequest
+	switch scanErr.Category {
+	case collect.ErrorCategoryAuth:
+		status = http.StatusUnauthorized
+	case collect.ErrorCategoryQuota:
+		status = http.StatusTooManyRequests
+	case collect.ErrorCategoryNetwork:
+		status = http.StatusBadGateway
+	case collect.ErrorCategoryDB, collect.ErrorCategoryUnknown:
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("X-Error-Category", string(scanErr.Category))
+	http.Error(w, err.Error(), status)
+}
+
+func CancelAllScansHandler(w http.ResponseWriter, r *http.Request) {
+	scanIds := collect.CancelAllScans()
+	fmt.Printf("Cancelled scans: %v\n", scanIds)
+	body := CancelAllScansResponse{
+		ScanIds: scanIds,
+	}
+	serializedBody, _ := json.Marshal(body)
+	setJsonHeader(w)
+	_, _ = w.Write(serializedBody)
+}
+
+// Interval of the keep-alive comments of the progress stream.
+const progressKeepAlive = 15 * time.Second
+
+// Streams the progress of running scans as server-sent events. With a scan_id
+// only that scan is streamed and the stream ends once the scan completes.
+func ProgressHandler(w http.ResponseWriter, r *http.Request) {
+	scanId, _ := getIntFromMap(mux.Vars(r), "scan_id")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	// The stream outlives the write timeout of the server.
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	progressUpdates, unsubscribe := collect.SubscribeProgress(scanId)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeEvent := func(progress collect.Progress) {
+		serializedProgress, _ := json.Marshal(progress)
+		fmt.Fprintf(w, "data: %s\n\n", serializedProgress)
+		flusher.Flush()
+	}
+	if scanId != 0 {
+		progress, running := collect.GetProgress(scanId)
+		writeEvent(progress)
+		if !running {
+			return
+		}
+	}
+	// Comments keep idle connections from being closed by proxies while a
+	// scan has no progress to report.
+	keepAlive := time.NewTicker(progressKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case progress := <-progressUpdates:
+			writeEvent(progress)
+			if scanId != 0 && progress.Completed {
+				return
+			}
+		}
+	}
+}
+
 func ListScansHandler(w http.ResponseWriter, r *http.Request) {
 	pageNo := getPageNumber(mux.Vars(r))
 	scans, totResults := db.GetScansFromDb(pageNo)
-	pageInfo := PaginationInfo{Page: pageNo, Size: totResults}
+	pageInfo := newPaginationInfo(pageNo, totResults, db.PageSize)
+	body := ScansResponse{
+		PageInfo: pageInfo,
+		Scans:    scans,
+	}
+	serializedBody, _ := json.Marshal(body)
+	setJsonHeader(w)
+	_, _ = w.Write(serializedBody)
+}
+
+// Lists the scans of a local directory, storage bucket (path) or of a drive
+// or gmail query (filter), most recent first.
+func ListScansBySourceHandler(w http.ResponseWriter, r *http.Request) {
+	pageNo := getPageNumber(mux.Vars(r))
+	path := r.URL.Query().Get("path")
+	filter := r.URL.Query().Get("filter")
+	if path == "" && filter == "" {
+		http.Error(w, "path or filter is required", http.StatusBadRequest)
+		return
+	}
+	scans, totResults := db.GetScansBySourceFromDb(path, filter, pageNo)
+	pageInfo := newPaginationInfo(pageNo, totResults, db.PageSize)
 	body := ScansResponse{
 		PageInfo: pageInfo,
 		Scans:    scans,
@@ -90,12 +371,89 @@ func DeleteScanHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// Exports the results of the scan to a new spreadsheet in the Google account
+// of the refresh token. Responds with the url of the spreadsheet while the
+// rows are still being appended.
+func ExportToSheetsHandler(w http.ResponseWriter, r *http.Request) {
+	scanId, _ := getIntFromMap(mux.Vars(r), "scan_id")
+	decoder := json.NewDecoder(r.Body)
+	var exportRequest ExportToSheetsRequest
+	err := decoder.Decode(&exportRequest)
+	if err != nil || exportRequest.RefreshToken == "" {
+		http.Error(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+	spreadsheetUrl, err := collect.ExportScanToSheets(scanId, exportRequest.RefreshToken)
+	if err != nil {
+		fmt.Printf("Could not export scanId=%v: %v\n", scanId, err)
+		writeScanError(w, err)
+		return
+	}
+	body := ExportToSheetsResponse{
+		SpreadsheetUrl: spreadsheetUrl,
+	}
+	serializedBody, _ := json.Marshal(body)
+	setJsonHeader(w)
+	_, _ = w.Write(serializedBody)
+}
+
+// Status of the latest export of the scan to a spreadsheet, e.g. to tell
+// whether all the rows were appended.
+func ExportStatusHandler(w http.ResponseWriter, r *http.Request) {
+	scanId, _ := getIntFromMap(mux.Vars(r), "scan_id")
+	status, ok := collect.GetExportStatus(scanId)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no export found for scanId=%v", scanId), http.StatusNotFound)
+		return
+	}
+	serializedBody, _ := json.Marshal(status)
+	setJsonHeader(w)
+	_, _ = w.Write(serializedBody)
+}
+
+// Totals of a local scan for each of its roots and across all of them.
+func ListScanRootsHandler(w http.ResponseWriter, r *http.Request) {
+	scanId, _ := getIntFromMap(mux.Vars(r), "scan_id")
+	roots := db.GetScanRootsFromDb(scanId)
+	body := ScanRootsResponse{
+		Roots: roots,
+	}
+	for _, root := range roots {
+		body.Total.Count += root.Count
+		body.Total.Size += root.Size
+	}
+	serializedBody, _ := json.Marshal(body)
+	setJsonHeader(w)
+	_, _ = w.Write(serializedBody)
+}
+
+// Checks that the file count and size of every directory of a local scan
+// add up to the files recorded under it.
+func ValidateScanHandler(w http.ResponseWriter, r *http.Request) {
+	scanId, _ := getIntFromMap(mux.Vars(r), "scan_id")
+	_, err := db.GetScanTypeFromDb(scanId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	directoriesChecked, mismatches := db.GetDirectoryMismatchesFromDb(scanId)
+	body := ValidateScanResponse{
+		ScanId:             scanId,
+		DirectoriesChecked: directoriesChecked,
+		Valid:              len(mismatches) == 0,
+		Mismatches:         mismatches,
+	}
+	serializedBody, _ := json.Marshal(body)
+	setJsonHeader(w)
+	_, _ = w.Write(serializedBody)
+}
+
 func ListMessageMetaDataHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pageNo := getPageNumber(mux.Vars(r))
 	scanId, _ := getIntFromMap(vars, "scan_id")
 	messageMetadata, totResults := db.GetMessageMetadataFromDb(scanId, pageNo)
-	pageInfo := PaginationInfo{Page: pageNo, Size: totResults}
+	pageInfo := newPaginationInfo(pageNo, totResults, db.PageSize)
 	body := MessageMetadataResponse{
 		PageInfo:        pageInfo,
 		MessageMetadata: messageMetadata,
@@ -105,6 +463,40 @@ func ListMessageMetaDataHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(serializedBody)
 }
 
+// Responds with the estimated number of messages matching the optional filter.
+func PreviewGmailFilterHandler(w http.ResponseWriter, r *http.Request) {
+	refreshToken := mux.Vars(r)["refresh_token"]
+	filter := r.URL.Query().Get("filter")
+	estimate, err := collect.PreviewGmailFilter(refreshToken, filter)
+	if err != nil {
+		fmt.Printf("Could not preview filter %q: %v\n", filter, err)
+		writeScanError(w, err)
+		return
+	}
+	body := PreviewGmailFilterResponse{
+		Filter:             filter,
+		ResultSizeEstimate: estimate,
+	}
+	serializedBody, _ := json.Marshal(body)
+	setJsonHeader(w)
+	_, _ = w.Write(serializedBody)
+}
+
+func ListMessageThreadsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pageNo := getPageNumber(mux.Vars(r))
+	scanId, _ := getIntFromMap(vars, "scan_id")
+	messageThreads, totResults := db.GetMessageThreadsFromDb(scanId, pageNo)
+	pageInfo := newPaginationInfo(pageNo, totResults, db.PageSize)
+	body := MessageThreadsResponse{
+		PageInfo:       pageInfo,
+		MessageThreads: messageThreads,
+	}
+	serializedBody, _ := json.Marshal(body)
+	setJsonHeader(w)
+	_, _ = w.Write(serializedBody)
+}
+
 func ListAlbumsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	refresh_token, present := vars["refresh_token"]
@@ -113,8 +505,18 @@ func ListAlbumsHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	albums := collect.ListAlbums(refresh_token)
-	pageInfo := PaginationInfo{Page: 1, Size: len(albums)}
+	maxAlbums := 0
+	if _, present := vars["max_albums"]; present {
+		var valid bool
+		maxAlbums, valid = getIntFromMap(vars, "max_albums")
+		if !valid || maxAlbums < 0 {
+			http.Error(w, "max_albums must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+	}
+	albums, hasMore := collect.ListAlbums(refresh_token, maxAlbums)
+	pageInfo := newPaginationInfo(1, len(albums), len(albums))
+	pageInfo.HasNext = hasMore
 	body := ListAlbumsResponse{
 		PageInfo: pageInfo,
 		Albums:   albums,
@@ -124,12 +526,52 @@ func ListAlbumsHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(serializedBody)
 }
 
+// Responds with the album and the number of media items in it, so that the
+// size of a scan of the album is known before starting it.
+func GetAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	album, err := collect.GetAlbum(vars["refresh_token"], vars["album_id"])
+	if err != nil {
+		fmt.Printf("Could not get album %q: %v\n", vars["album_id"], err)
+		writeScanError(w, err)
+		return
+	}
+	mediaItemsCount, _ := strconv.ParseInt(album.MediaItemsCount, 10, 64)
+	body := GetAlbumResponse{
+		Album:           album,
+		MediaItemsCount: mediaItemsCount,
+	}
+	serializedBody, _ := json.Marshal(body)
+	setJsonHeader(w)
+	_, _ = w.Write(serializedBody)
+}
+
+// Redirects to the content of a media item found by a photos scan. Requires
+// the refresh token of the account the media item belongs to.
+func DownloadPhotoHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	scanId, _ := getIntFromMap(vars, "scan_id")
+	id, _ := getIntFromMap(vars, "id")
+	mediaItemId, err := db.GetMediaItemIdFromDb(scanId, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	downloadUrl, err := collect.GetMediaItemDownloadUrl(vars["refresh_token"], mediaItemId)
+	if err != nil {
+		fmt.Printf("Could not get media item %q: %v\n", mediaItemId, err)
+		writeScanError(w, err)
+		return
+	}
+	http.Redirect(w, r, downloadUrl, http.StatusFound)
+}
+
 func ListPhotosHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pageNo := getPageNumber(mux.Vars(r))
 	scanId, _ := getIntFromMap(vars, "scan_id")
 	photosMediaItem, totResults := db.GetPhotosMediaItemFromDb(scanId, pageNo)
-	pageInfo := PaginationInfo{Page: pageNo, Size: totResults}
+	pageInfo := newPaginationInfo(pageNo, totResults, db.PageSize)
 	body := PhotosMediaItemResponse{
 		PageInfo:        pageInfo,
 		PhotosMediaItem: photosMediaItem,
@@ -143,10 +585,17 @@ func ListScanDataHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pageNo := getPageNumber(mux.Vars(r))
 	scanId, _ := getIntFromMap(vars, "scan_id")
+	scanType, err := db.GetScanTypeFromDb(scanId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	scanData, totResults := db.GetScanDataFromDb(scanId, pageNo)
-	pageInfo := PaginationInfo{Page: pageNo, Size: totResults}
+	pageInfo := newPaginationInfo(pageNo, totResults, db.PageSize)
 	body := ScanDataResponse{
 		PageInfo: pageInfo,
+		ScanType: scanType,
+		PathKind: pathKinds[scanType],
 		ScanData: scanData,
 	}
 	serializedBody, _ := json.Marshal(body)
@@ -174,20 +623,34 @@ func getPageNumber(vars map[string]string) int {
 	return page
 }
 
+// Builds the pagination info for page of a listing with size results in total.
+func newPaginationInfo(page int, size int, pageSize int) PaginationInfo {
+	totalPages := 0
+	if pageSize > 0 {
+		totalPages = (size + pageSize - 1) / pageSize
+	}
+	return PaginationInfo{
+		Size:       size,
+		Page:       page,
+		TotalPages: totalPages,
+		HasNext:    page < totalPages,
+		HasPrev:    page > 1,
+	}
+}
+
 func setJsonHeader(w http.ResponseWriter) {
 	w.Header().Set(
 		"Content-Type",
 		"application/json",
 	)
-	w.Header().Set(
-		"Access-Control-Allow-Origin",
-		"http://localhost:8080",
-	)
 }
 
 type PaginationInfo struct {
-	Size int `json:"size"`
-	Page int `json:"page"`
+	Size       int  `json:"size"`
+	Page       int  `json:"page"`
+	TotalPages int  `json:"total_pages"`
+	HasNext    bool `json:"has_next"`
+	HasPrev    bool `json:"has_prev"`
 }
 
 type ScansResponse struct {
@@ -195,8 +658,17 @@ type ScansResponse struct {
 	Scans    []db.Scan      `json:"scans"`
 }
 
+// What the path of the scan data refers to, for each scan type.
+var pathKinds = map[string]string{
+	"local":          "file_path",
+	"google_drive":   "drive_file_id",
+	"google_storage": "storage_media_link",
+}
+
 type ScanDataResponse struct {
 	PageInfo PaginationInfo `json:"pagination_info"`
+	ScanType string         `json:"scan_type"`
+	PathKind string         `json:"path_kind"`
 	ScanData []db.ScanData  `json:"scan_data"`
 }
 
@@ -213,16 +685,91 @@ type DoScanResponse struct {
 	ScanId int `json:"scan_id"`
 }
 
+type SearchResponse struct {
+	Query   string                `json:"query"`
+	Limit   int                   `json:"limit"`
+	Results collect.SearchResults `json:"results"`
+}
+
+type ConfigResponse struct {
+	ListenAddr   string `json:"listen_addr"`
+	WriteTimeout string `json:"write_timeout"`
+	ReadTimeout  string `json:"read_timeout"`
+	FrontendUrl  string `json:"frontend_url"`
+	CorsMode     string `json:"cors_mode"`
+	// Not a secret, it is sent to the browser while linking an account.
+	OauthClientId string           `json:"oauth_client_id"`
+	OauthTimeout  string           `json:"oauth_token_timeout"`
+	Database      db.DatabaseInfo  `json:"database"`
+	PageSize      int              `json:"page_size"`
+	Collect       collect.Settings `json:"collect"`
+}
+
+type RerunScanRequest struct {
+	ScanId       int    `json:"scan_id"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RerunScanResult struct {
+	ScanId        int    `json:"scan_id"`
+	NewScanId     int    `json:"new_scan_id,omitempty"`
+	Error         string `json:"error,omitempty"`
+	ErrorCategory string `json:"error_category,omitempty"`
+}
+
+type RerunScansResponse struct {
+	Results []RerunScanResult `json:"results"`
+}
+
+type ScanRootsResponse struct {
+	Roots []db.RootStats `json:"roots"`
+	Total db.ItemStats   `json:"total"`
+}
+
+type ValidateScanResponse struct {
+	ScanId             int                    `json:"scan_id"`
+	DirectoriesChecked int                    `json:"directories_checked"`
+	Valid              bool                   `json:"valid"`
+	Mismatches         []db.DirectoryMismatch `json:"mismatches"`
+}
+
+type ExportToSheetsRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type ExportToSheetsResponse struct {
+	SpreadsheetUrl string `json:"spreadsheet_url"`
+}
+
+type CancelAllScansResponse struct {
+	ScanIds []int `json:"cancelled_scan_ids"`
+}
+
 type MessageMetadataResponse struct {
 	PageInfo        PaginationInfo           `json:"pagination_info"`
 	MessageMetadata []db.MessageMetadataRead `json:"message_metadata"`
 }
 
+type PreviewGmailFilterResponse struct {
+	Filter             string `json:"filter"`
+	ResultSizeEstimate int64  `json:"result_size_estimate"`
+}
+
+type MessageThreadsResponse struct {
+	PageInfo       PaginationInfo     `json:"pagination_info"`
+	MessageThreads []db.MessageThread `json:"message_threads"`
+}
+
 type PhotosMediaItemResponse struct {
 	PageInfo        PaginationInfo           `json:"pagination_info"`
 	PhotosMediaItem []db.PhotosMediaItemRead `json:"photos_media_item"`
 }
 
+type GetAlbumResponse struct {
+	Album           collect.Album `json:"album"`
+	MediaItemsCount int64         `json:"media_items_count"`
+}
+
 type ListAlbumsResponse struct {
 	PageInfo PaginationInfo  `json:"pagination_info"`
 	Albums   []collect.Album `json:"albums"`
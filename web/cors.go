@@ -0,0 +1,53 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/jyothri/hdd/constants"
+)
+
+// Origins allowed in the dev cors mode besides the frontend url.
+var devOriginPattern = regexp.MustCompile(`^https?://(localhost|127\.0\.0\.1|\[::1\])(:[0-9]+)?$`)
+
+func validateCorsMode() error {
+	switch constants.CorsMode {
+	case "strict", "dev":
+		return nil
+	default:
+		return fmt.Errorf("unsupported cors_mode %q. Expected strict or dev", constants.CorsMode)
+	}
+}
+
+// Reports whether responses may be shared with the origin. Only the frontend
+// url is allowed in strict mode. Dev mode also allows localhost on any port.
+func isAllowedOrigin(origin string) bool {
+	if origin == constants.FrontendUrl {
+		return true
+	}
+	return constants.CorsMode == "dev" && devOriginPattern.MatchString(origin)
+}
+
+// Sets the CORS headers for allowed origins and answers preflight requests.
+// The origin is always echoed back instead of a wildcard, which is not
+// allowed along with credentials.
+func corsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" || !isAllowedOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
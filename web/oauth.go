@@ -1,7 +1,9 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -32,29 +34,44 @@ func GoogleAccountLinkingHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Exchange authZ for refresh token.
 	reqURL := fmt.Sprintf("%s?client_id=%s&client_secret=%s&code=%s&grant_type=%s&redirect_uri=%s", googleTokenUrl, clientId, clientSecret, code, grantType, redirectUri)
-	req, err := http.NewRequest(http.MethodPost, reqURL, nil)
+	ctx, cancel := context.WithTimeout(r.Context(), constants.OauthTokenTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, nil)
 	if err != nil {
 		fmt.Printf("could not create HTTP request: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 	// We set this header since we want the response
 	// as JSON
 	req.Header.Set("accept", "application/json")
+	req.Header.Set("User-Agent", constants.UserAgent)
 
 	// We will be using `httpClient` to make external HTTP requests later in our code
 	httpClient := http.Client{}
 
 	// Send out the HTTP request
 	res, err := httpClient.Do(req)
+	if errors.Is(err, context.DeadlineExceeded) {
+		fmt.Printf("timed out exchanging the authorization code after %v: %v", constants.OauthTokenTimeout, err)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
 	if err != nil {
 		fmt.Printf("could not send HTTP request: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 	defer res.Body.Close()
 
 	// Parse the request body into the `OAuthAccessResponse` struct
 	var t OAuthAccessResponse
 	if err := json.NewDecoder(res.Body).Decode(&t); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			fmt.Printf("timed out reading the token response: %v", err)
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
 		fmt.Printf("could not parse JSON response: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -8,17 +8,27 @@ import (
 	"github.com/gorilla/mux"
 )
 
+const (
+	listenAddr   = ":8090"
+	writeTimeout = 10 * time.Second
+	readTimeout  = 10 * time.Second
+)
+
 func StartWebServer() {
+	err := validateCorsMode()
+	if err != nil {
+		log.Fatal(err)
+	}
 	r := mux.NewRouter()
 	api(r)
 	oauth(r)
 	spa(r)
 	srv := &http.Server{
-		Handler: r,
-		Addr:    ":8090",
+		Handler: corsHandler(r),
+		Addr:    listenAddr,
 		// Good practice: enforce timeouts for servers you create!
-		WriteTimeout: 10 * time.Second,
-		ReadTimeout:  10 * time.Second,
+		WriteTimeout: writeTimeout,
+		ReadTimeout:  readTimeout,
 	}
 	log.Fatal(srv.ListenAndServe())
 }